@@ -0,0 +1,185 @@
+package fieldcalculator
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Aggregates flatten every argument into one list of values. Blank (nil) values are skipped, any other
+// value that is not a number is an error pointing at the argument it came from.
+
+// numbersOf collects the numbers passed to fn
+func numbersOf(fn string, ts []Token) ([]interface{}, error) {
+	values := make([]interface{}, 0)
+	for i, a := range ts {
+		for _, t := range flattenTokens([]Token{a}) {
+			if t.Value == nil {
+				continue
+			}
+			if !isNumber(t.Value) {
+				return nil, argError(i, t.Value, fmt.Sprintf("Field for %s is not a number", fn))
+			}
+			values = append(values, t.Value)
+		}
+	}
+	return values, nil
+}
+
+// aggregate builds a function over the numbers of all its arguments
+func aggregate(fn string, f func([]interface{}) (interface{}, error)) func([]Token) (Token, error) {
+	return func(ts []Token) (Token, error) {
+		values, err := numbersOf(fn, ts)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		v, err := f(values)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		return staticToken(v), nil
+	}
+}
+
+func sum(values []interface{}) interface{} {
+	var s interface{} = int64(0)
+	for _, v := range values {
+		s = addNumbers(s, v)
+	}
+	return s
+}
+
+func average(values []interface{}) interface{} {
+	return divideNumbers(sum(values), int64(len(values)))
+}
+
+// variance is the sample variance, it needs at least two values
+func variance(fn string, values []interface{}) (interface{}, error) {
+	if len(values) < 2 {
+		return nil, errors.New(fmt.Sprintf("%s needs at least 2 numbers, got %d", fn, len(values)))
+	}
+	mean := average(values)
+	var sq interface{} = int64(0)
+	for _, v := range values {
+		d := subtractNumbers(v, mean)
+		sq = addNumbers(sq, multiplyNumbers(d, d))
+	}
+	return divideNumbers(sq, int64(len(values)-1)), nil
+}
+
+// extreme picks the value that wins against every other by compareNumbers, 0 for no values
+func extreme(values []interface{}, wins func(int) bool) interface{} {
+	if len(values) == 0 {
+		return int64(0)
+	}
+	m := values[0]
+	for _, v := range values[1:] {
+		if wins(compareNumbers(v, m)) {
+			m = v
+		}
+	}
+	return m
+}
+
+var (
+	fnSum = aggregate("SUM", func(values []interface{}) (interface{}, error) {
+		return sum(values), nil
+	})
+	fnAverage = aggregate("AVERAGE", func(values []interface{}) (interface{}, error) {
+		if len(values) == 0 {
+			return nil, errors.New("AVERAGE of no numbers")
+		}
+		return average(values), nil
+	})
+	fnMin = aggregate("MIN", func(values []interface{}) (interface{}, error) {
+		return extreme(values, func(c int) bool { return c < 0 }), nil
+	})
+	fnMax = aggregate("MAX", func(values []interface{}) (interface{}, error) {
+		return extreme(values, func(c int) bool { return c > 0 }), nil
+	})
+	// fnProduct is 0 for no numbers, like spreadsheets
+	fnProduct = aggregate("PRODUCT", func(values []interface{}) (interface{}, error) {
+		if len(values) == 0 {
+			return int64(0), nil
+		}
+		var p interface{} = int64(1)
+		for _, v := range values {
+			p = multiplyNumbers(p, v)
+		}
+		return p, nil
+	})
+	fnMedian = aggregate("MEDIAN", func(values []interface{}) (interface{}, error) {
+		if len(values) == 0 {
+			return nil, errors.New("MEDIAN of no numbers")
+		}
+		sorted := append(make([]interface{}, 0, len(values)), values...)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return compareNumbers(sorted[i], sorted[j]) < 0
+		})
+		mid := len(sorted) / 2
+		if len(sorted)%2 == 1 {
+			return sorted[mid], nil
+		}
+		return average(sorted[mid-1 : mid+1]), nil
+	})
+	// fnMode returns the most frequent number, ties go to the one seen first
+	fnMode = aggregate("MODE", func(values []interface{}) (interface{}, error) {
+		// numbers are counted by their exact value so 2, 2.0 and a decimal 2 are the same number
+		counts := make(map[string]int)
+		order := make([]string, 0)
+		firsts := make(map[string]interface{})
+		for _, v := range values {
+			k := fmt.Sprint(v)
+			if r, ok := toRat(v); ok {
+				k = r.RatString()
+			}
+			if counts[k] == 0 {
+				order = append(order, k)
+				firsts[k] = v
+			}
+			counts[k]++
+		}
+		var best interface{}
+		bestCount := 1
+		for _, k := range order {
+			if counts[k] > bestCount {
+				best, bestCount = firsts[k], counts[k]
+			}
+		}
+		if best == nil {
+			return nil, errors.New("MODE found no repeated number")
+		}
+		return best, nil
+	})
+	fnVar = aggregate("VAR", func(values []interface{}) (interface{}, error) {
+		return variance("VAR", values)
+	})
+	fnStdev = aggregate("STDEV", func(values []interface{}) (interface{}, error) {
+		v, err := variance("STDEV", values)
+		if err != nil {
+			return nil, err
+		}
+		f, _ := ToFloat64(v)
+		return math.Sqrt(f), nil
+	})
+)
+
+// counter builds the COUNT family, counting the values test accepts
+func counter(test func(interface{}) bool) func([]Token) (Token, error) {
+	return func(ts []Token) (Token, error) {
+		var n int64
+		for _, t := range flattenTokens(ts) {
+			if test(t.Value) {
+				n++
+			}
+		}
+		return staticToken(n), nil
+	}
+}
+
+var (
+	fnCount      = counter(isNumber)
+	fnCountA     = counter(func(v interface{}) bool { return v != nil })
+	fnCountBlank = counter(func(v interface{}) bool { return v == nil || v == "" })
+)
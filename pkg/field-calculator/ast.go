@@ -0,0 +1,381 @@
+package fieldcalculator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Node is the typed form of a parsed formula, it marshals to JSON and can be loaded back into an Evaluator
+type Node interface {
+	json.Marshaler
+	json.Unmarshaler
+	token() (Token, error)
+}
+
+// FuncCallNode is a call of a function or, when Operator is set, an operator
+type FuncCallNode struct {
+	Name     string
+	Operator bool
+	Args     []Node
+	Position int
+}
+
+// FieldNode is a [path.to.field] reference
+type FieldNode struct {
+	Name     string
+	Position int
+}
+
+// LiteralNode is a constant, Value holds an int64, float64, *big.Rat, string, bool or nil
+type LiteralNode struct {
+	Value    interface{}
+	Position int
+}
+
+// ScopeNode is a parenthesized group
+type ScopeNode struct {
+	Body     []Node
+	Position int
+}
+
+var (
+	_ Node = (*FuncCallNode)(nil)
+	_ Node = (*FieldNode)(nil)
+	_ Node = (*LiteralNode)(nil)
+	_ Node = (*ScopeNode)(nil)
+)
+
+type jsonNode struct {
+	Type     string            `json:"type"`
+	Name     string            `json:"name,omitempty"`
+	Operator bool              `json:"operator,omitempty"`
+	Kind     string            `json:"kind,omitempty"`
+	Value    json.RawMessage   `json:"value,omitempty"`
+	Args     []json.RawMessage `json:"args,omitempty"`
+	Body     []json.RawMessage `json:"body,omitempty"`
+	Position int               `json:"position"`
+}
+
+// UnmarshalNode decodes any node type from its JSON form
+func UnmarshalNode(data []byte) (Node, error) {
+	var jn jsonNode
+	if err := json.Unmarshal(data, &jn); err != nil {
+		return nil, err
+	}
+	var n Node
+	switch jn.Type {
+	case "func":
+		n = &FuncCallNode{}
+	case "field":
+		n = &FieldNode{}
+	case "literal":
+		n = &LiteralNode{}
+	case "scope":
+		n = &ScopeNode{}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown node type: '%s'", jn.Type))
+	}
+	if err := n.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func unmarshalNodes(raw []json.RawMessage) ([]Node, error) {
+	ns := make([]Node, 0, len(raw))
+	for _, r := range raw {
+		n, err := UnmarshalNode(r)
+		if err != nil {
+			return nil, err
+		}
+		ns = append(ns, n)
+	}
+	return ns, nil
+}
+
+// checkType decodes data and makes sure it describes a node of type typ
+func checkType(data []byte, typ string) (jsonNode, error) {
+	var jn jsonNode
+	if err := json.Unmarshal(data, &jn); err != nil {
+		return jn, err
+	}
+	if jn.Type != typ {
+		return jn, errors.New(fmt.Sprintf("Expected a %s node, got '%s'", typ, jn.Type))
+	}
+	return jn, nil
+}
+
+func (n *FuncCallNode) MarshalJSON() ([]byte, error) {
+	args := n.Args
+	if args == nil {
+		args = []Node{}
+	}
+	return json.Marshal(struct {
+		Type     string `json:"type"`
+		Name     string `json:"name"`
+		Operator bool   `json:"operator,omitempty"`
+		Args     []Node `json:"args"`
+		Position int    `json:"position"`
+	}{"func", n.Name, n.Operator, args, n.Position})
+}
+
+func (n *FuncCallNode) UnmarshalJSON(data []byte) error {
+	jn, err := checkType(data, "func")
+	if err != nil {
+		return err
+	}
+	args, err := unmarshalNodes(jn.Args)
+	if err != nil {
+		return err
+	}
+	*n = FuncCallNode{Name: jn.Name, Operator: jn.Operator, Args: args, Position: jn.Position}
+	return nil
+}
+
+func (n *FuncCallNode) token() (Token, error) {
+	tt := Function
+	if n.Operator {
+		tt = Operator
+	}
+	ts := []Token{*(&Token{
+		Type:     tt,
+		Value:    n.Name,
+		Position: n.Position,
+	})}
+	for _, a := range n.Args {
+		t, err := a.token()
+		if err != nil {
+			return *(&Token{}), err
+		}
+		ts = append(ts, t)
+	}
+	return *(&Token{
+		Type:     FuncScope,
+		Value:    ts,
+		Position: n.Position,
+	}), nil
+}
+
+func (n *FieldNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type     string `json:"type"`
+		Name     string `json:"name"`
+		Position int    `json:"position"`
+	}{"field", n.Name, n.Position})
+}
+
+func (n *FieldNode) UnmarshalJSON(data []byte) error {
+	jn, err := checkType(data, "field")
+	if err != nil {
+		return err
+	}
+	*n = FieldNode{Name: jn.Name, Position: jn.Position}
+	return nil
+}
+
+func (n *FieldNode) token() (Token, error) {
+	path, err := parsePath(n.Name, 0, len(n.Name))
+	if err != nil {
+		return *(&Token{}), err
+	}
+	return *(&Token{
+		Type:     Field,
+		Value:    n.Name,
+		Position: n.Position,
+		path:     &compiledPath{steps: path},
+	}), nil
+}
+
+// literalKindName names the JSON kind of a literal value
+func literalKindName(v interface{}) (string, error) {
+	switch v.(type) {
+	case int64:
+		return "integer", nil
+	case float64:
+		return "number", nil
+	case *big.Rat:
+		return "decimal", nil
+	case string:
+		return "string", nil
+	case bool:
+		return "bool", nil
+	case nil:
+		return "null", nil
+	}
+	return "", errors.New(fmt.Sprintf("Literal of type %T cannot be represented", v))
+}
+
+// literalJSON is the value stored in the JSON form of a literal, decimals are kept as strings so they stay exact
+func literalJSON(v interface{}) interface{} {
+	if r, ok := v.(*big.Rat); ok {
+		return decimalString(r)
+	}
+	return v
+}
+
+func (n *LiteralNode) MarshalJSON() ([]byte, error) {
+	kind, err := literalKindName(n.Value)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		Type     string      `json:"type"`
+		Kind     string      `json:"kind"`
+		Value    interface{} `json:"value"`
+		Position int         `json:"position"`
+	}{"literal", kind, literalJSON(n.Value), n.Position})
+}
+
+func (n *LiteralNode) UnmarshalJSON(data []byte) error {
+	jn, err := checkType(data, "literal")
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	switch jn.Kind {
+	case "integer":
+		var i int64
+		err = json.Unmarshal(jn.Value, &i)
+		v = i
+	case "decimal":
+		var s string
+		if err = json.Unmarshal(jn.Value, &s); err == nil {
+			r, ok := new(big.Rat).SetString(s)
+			if !ok {
+				err = errors.New(fmt.Sprintf("Bad decimal literal: '%s'", s))
+			}
+			v = r
+		}
+	case "number":
+		var f float64
+		err = json.Unmarshal(jn.Value, &f)
+		v = f
+	case "string":
+		var s string
+		err = json.Unmarshal(jn.Value, &s)
+		v = s
+	case "bool":
+		var b bool
+		err = json.Unmarshal(jn.Value, &b)
+		v = b
+	case "null":
+	default:
+		err = errors.New(fmt.Sprintf("Unknown literal kind: '%s'", jn.Kind))
+	}
+	if err != nil {
+		return err
+	}
+	*n = LiteralNode{Value: v, Position: jn.Position}
+	return nil
+}
+
+func (n *LiteralNode) token() (Token, error) {
+	if _, err := literalKindName(n.Value); err != nil {
+		return *(&Token{}), err
+	}
+	return *(&Token{
+		Type:     Static,
+		Value:    n.Value,
+		Position: n.Position,
+	}), nil
+}
+
+func (n *ScopeNode) MarshalJSON() ([]byte, error) {
+	body := n.Body
+	if body == nil {
+		body = []Node{}
+	}
+	return json.Marshal(struct {
+		Type     string `json:"type"`
+		Body     []Node `json:"body"`
+		Position int    `json:"position"`
+	}{"scope", body, n.Position})
+}
+
+func (n *ScopeNode) UnmarshalJSON(data []byte) error {
+	jn, err := checkType(data, "scope")
+	if err != nil {
+		return err
+	}
+	body, err := unmarshalNodes(jn.Body)
+	if err != nil {
+		return err
+	}
+	*n = ScopeNode{Body: body, Position: jn.Position}
+	return nil
+}
+
+func (n *ScopeNode) token() (Token, error) {
+	ts := make([]Token, 0, len(n.Body))
+	for _, b := range n.Body {
+		t, err := b.token()
+		if err != nil {
+			return *(&Token{}), err
+		}
+		ts = append(ts, t)
+	}
+	return *(&Token{
+		Type:     Scope,
+		Value:    ts,
+		Position: n.Position,
+	}), nil
+}
+
+// nodeFromToken builds the typed node for a parsed token
+func nodeFromToken(t Token) (Node, error) {
+	switch t.Type {
+	case FuncScope:
+		ts := t.Value.([]Token)
+		args := make([]Node, 0, len(ts)-1)
+		for _, a := range ts[1:] {
+			n, err := nodeFromToken(a)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, n)
+		}
+		return &FuncCallNode{
+			Name:     ts[0].Value.(string),
+			Operator: ts[0].Type == Operator,
+			Args:     args,
+			Position: ts[0].Position,
+		}, nil
+	case Scope:
+		ts := t.Value.([]Token)
+		body := make([]Node, 0, len(ts))
+		for _, b := range ts {
+			n, err := nodeFromToken(b)
+			if err != nil {
+				return nil, err
+			}
+			body = append(body, n)
+		}
+		return &ScopeNode{Body: body, Position: t.Position}, nil
+	case Field:
+		return &FieldNode{Name: t.Value.(string), Position: t.Position}, nil
+	case Static:
+		if _, err := literalKindName(t.Value); err != nil {
+			return nil, err
+		}
+		return &LiteralNode{Value: t.Value, Position: t.Position}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unhandled type in AST:%v", t.Type))
+}
+
+// collectFields lists every field reference in tokens
+func collectFields(tokens []Token) []Token {
+	fields := make([]Token, 0)
+	for _, t := range tokens {
+		switch t.Type {
+		case Field:
+			fields = append(fields, t)
+		case Scope:
+			fields = append(fields, collectFields(t.Value.([]Token))...)
+		case FuncScope:
+			fields = append(fields, collectFields(t.Value.([]Token)[1:])...)
+		}
+	}
+	return fields
+}
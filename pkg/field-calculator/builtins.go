@@ -0,0 +1,290 @@
+package fieldcalculator
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+)
+
+// staticToken wraps a computed value
+func staticToken(v interface{}) Token {
+	return *(&Token{
+		Type:  Static,
+		Value: v,
+	})
+}
+
+// listToken wraps computed values as a list
+func listToken(ts []Token) Token {
+	return *(&Token{
+		Type:  Scope,
+		Value: ts,
+	})
+}
+
+// flattenTokens expands list arguments so aggregates can treat every value the same
+func flattenTokens(ts []Token) []Token {
+	var rs []Token = make([]Token, 0, len(ts))
+	for _, t := range ts {
+		if t.Type == Scope {
+			rs = append(rs, flattenTokens(t.Value.([]Token))...)
+			continue
+		}
+		rs = append(rs, t)
+	}
+	return rs
+}
+
+// elementwise applies fn to a and b, a list on either side is applied per element and
+// a single value is repeated against the other side's list
+func elementwise(a, b Token, fn func(a, b interface{}) (interface{}, error)) (Token, error) {
+	if a.Type != Scope && b.Type != Scope {
+		v, err := fn(a.Value, b.Value)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		return staticToken(v), nil
+	}
+	as, bs := flattenTokens([]Token{a}), flattenTokens([]Token{b})
+	l := len(as)
+	if len(as) == 1 {
+		l = len(bs)
+	} else if len(bs) != 1 && len(bs) != len(as) {
+		return *(&Token{}), errors.New(fmt.Sprintf("List lengths differ: %d and %d", len(as), len(bs)))
+	}
+	var rts []Token = make([]Token, 0, l)
+	for i := 0; i < l; i++ {
+		av, bv := as[0].Value, bs[0].Value
+		if len(as) > 1 {
+			av = as[i].Value
+		}
+		if len(bs) > 1 {
+			bv = bs[i].Value
+		}
+		v, err := fn(av, bv)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		rts = append(rts, staticToken(v))
+	}
+	return listToken(rts), nil
+}
+
+// elementwiseN is elementwise for any number of arguments, lists have to share one length
+func elementwiseN(ts []Token, fn func([]interface{}) (interface{}, error)) (Token, error) {
+	lists := make([][]Token, 0, len(ts))
+	l, anyList := 1, false
+	for _, t := range ts {
+		vs := []Token{t}
+		if t.Type == Scope {
+			vs = flattenTokens(vs)
+			anyList = true
+			if len(vs) != 1 {
+				if l != 1 && l != len(vs) {
+					return *(&Token{}), errors.New(fmt.Sprintf("List lengths differ: %d and %d", l, len(vs)))
+				}
+				l = len(vs)
+			}
+		}
+		lists = append(lists, vs)
+	}
+	var rts []Token = make([]Token, 0, l)
+	for i := 0; i < l; i++ {
+		args := make([]interface{}, 0, len(lists))
+		for _, vs := range lists {
+			if len(vs) == 1 {
+				args = append(args, vs[0].Value)
+			} else {
+				args = append(args, vs[i].Value)
+			}
+		}
+		v, err := fn(args)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		if !anyList {
+			return staticToken(v), nil
+		}
+		rts = append(rts, staticToken(v))
+	}
+	return listToken(rts), nil
+}
+
+// mapTokens applies fn to a single value or to every element of a list
+func mapTokens(a Token, fn func(a interface{}) (interface{}, error)) (Token, error) {
+	if a.Type != Scope {
+		v, err := fn(a.Value)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		return staticToken(v), nil
+	}
+	as := flattenTokens([]Token{a})
+	var rts []Token = make([]Token, 0, len(as))
+	for _, t := range as {
+		v, err := fn(t.Value)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		rts = append(rts, staticToken(v))
+	}
+	return listToken(rts), nil
+}
+
+// formatValue renders a value the way string degradation shows it
+func formatValue(v interface{}) string {
+	switch f := v.(type) {
+	case float64:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(f, 10)
+	case *big.Rat:
+		return decimalString(f)
+	}
+	return fmt.Sprint(v)
+}
+
+// numberPair checks both operands of an arithmetic operator are numbers
+func numberPair(op string, a, b interface{}) error {
+	if !isNumber(a) {
+		return argError(0, a, fmt.Sprintf("Field for %s is not a number", op))
+	}
+	if !isNumber(b) {
+		return argError(1, b, fmt.Sprintf("Field for %s is not a number", op))
+	}
+	return nil
+}
+
+// sumNumbers adds up values, the sum is a float64 once the column they came from holds floats
+func sumNumbers(values []interface{}, floats bool) interface{} {
+	s := sum(values)
+	if i, ok := s.(int64); ok && floats {
+		return float64(i)
+	}
+	return s
+}
+
+// blankAs is what a blank (nil) stands for next to other: 0 beside numbers and blanks, "" beside text
+// and FALSE beside booleans, like empty cells in spreadsheets
+func blankAs(v, other interface{}) interface{} {
+	if v != nil {
+		return v
+	}
+	switch other.(type) {
+	case string:
+		return ""
+	case bool:
+		return false
+	}
+	return int64(0)
+}
+
+// blanksAsNumbers turns blanks into 0 for arithmetic
+func blanksAsNumbers(a, b interface{}) (interface{}, interface{}) {
+	return blankAs(a, nil), blankAs(b, nil)
+}
+
+// compareValues orders a and b numerically when both are numbers, otherwise by their text
+func compareValues(a, b interface{}) int {
+	a, b = blankAs(a, b), blankAs(b, a)
+	if isNumber(a) && isNumber(b) {
+		return compareNumbers(a, b)
+	}
+	as, bs := formatValue(a), formatValue(b)
+	if as == bs {
+		return 0
+	} else if as < bs {
+		return -1
+	}
+	return 1
+}
+
+// equalValues is compareValues == 0 except that floats only have to be equal within floatTolerance
+func equalValues(a, b interface{}) bool {
+	if a, b := blankAs(a, b), blankAs(b, a); isNumber(a) && isNumber(b) {
+		return equalNumbers(a, b)
+	}
+	return compareValues(a, b) == 0
+}
+
+// equality builds = and <>
+func equality(equal bool) func([]Token) (Token, error) {
+	return func(ts []Token) (Token, error) {
+		return elementwise(ts[0], ts[1], func(a, b interface{}) (interface{}, error) {
+			return equalValues(a, b) == equal, nil
+		})
+	}
+}
+
+// comparison builds an element-wise comparison operator from a test on compareValues
+func comparison(test func(int) bool) func([]Token) (Token, error) {
+	return func(ts []Token) (Token, error) {
+		return elementwise(ts[0], ts[1], func(a, b interface{}) (interface{}, error) {
+			return test(compareValues(a, b)), nil
+		})
+	}
+}
+
+var (
+	opEqual        = equality(true)
+	opNotEqual     = equality(false)
+	opLess         = comparison(func(c int) bool { return c < 0 })
+	opLessEqual    = comparison(func(c int) bool { return c <= 0 })
+	opGreater      = comparison(func(c int) bool { return c > 0 })
+	opGreaterEqual = comparison(func(c int) bool { return c >= 0 })
+)
+
+func opMultiply(ts []Token) (Token, error) {
+	return elementwise(ts[0], ts[1], func(a, b interface{}) (interface{}, error) {
+		a, b = blanksAsNumbers(a, b)
+		if err := numberPair("*", a, b); err != nil {
+			return nil, err
+		}
+		return multiplyNumbers(a, b), nil
+	})
+}
+
+// opSubtract subtracts with two arguments and negates with one
+func opSubtract(ts []Token) (Token, error) {
+	if len(ts) == 1 {
+		return mapTokens(ts[0], func(a interface{}) (interface{}, error) {
+			a = blankAs(a, nil)
+			if !isNumber(a) {
+				return nil, argError(0, a, "Field for - is not a number")
+			}
+			return negateNumber(a), nil
+		})
+	}
+	return elementwise(ts[0], ts[1], func(a, b interface{}) (interface{}, error) {
+		a, b = blanksAsNumbers(a, b)
+		if err := numberPair("-", a, b); err != nil {
+			return nil, err
+		}
+		return subtractNumbers(a, b), nil
+	})
+}
+
+func opDivide(ts []Token) (Token, error) {
+	return elementwise(ts[0], ts[1], func(a, b interface{}) (interface{}, error) {
+		a, b = blanksAsNumbers(a, b)
+		if err := numberPair("/", a, b); err != nil {
+			return nil, err
+		}
+		if isZero(b) {
+			return nil, argError(1, b, "Division by zero")
+		}
+		return divideNumbers(a, b), nil
+	})
+}
+
+// opAdd adds numbers and degrades to string concatenation as soon as one side is not a number
+func opAdd(ts []Token) (Token, error) {
+	return elementwise(ts[0], ts[1], func(a, b interface{}) (interface{}, error) {
+		a, b = blankAs(a, b), blankAs(b, a)
+		if isNumber(a) && isNumber(b) {
+			return addNumbers(a, b), nil
+		}
+		return formatValue(a) + formatValue(b), nil
+	})
+}
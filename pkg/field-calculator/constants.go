@@ -1,9 +1,7 @@
 package fieldcalculator
 
 import (
-	"errors"
-	"fmt"
-	"math"
+	"sync"
 )
 
 // TYPES
@@ -22,230 +20,618 @@ type Token struct {
 	Type     TokenType
 	Value    interface{}
 	Position int
+
+	// path is the parsed path of a Field token
+	path *compiledPath
+}
+
+type ArgKind uint8
+
+const (
+	NumberArg ArgKind = 1 << iota
+	StringArg
+	BoolArg
+	ListArg
+
+	AnyArg = NumberArg | StringArg | BoolArg | ListArg
+)
+
+// Variadic as MaxArgs lets a function take any number of trailing arguments
+const Variadic = -1
+
+// Thunk evaluates an argument of a lazy function on demand
+type Thunk func() (Token, error)
+
+type FunctionDef struct {
+	Name             string
+	MinArgs, MaxArgs int
+	// Args holds the accepted kinds per argument, the last entry repeats for any further arguments
+	Args []ArgKind
+	Fn   func([]Token) (Token, error)
+	// Lazy replaces Fn for functions deciding themselves which arguments get evaluated
+	Lazy func([]Thunk) (Token, error)
+	// Validate checks the unevaluated arguments at parse time, after their count and kinds
+	Validate func([]Token) error
 }
 
 type Env struct {
 	Values map[string]interface{}
 	Parent *Env
+
+	mu sync.RWMutex
 }
 
 var operatorPrecedence map[string]int = map[string]int{
-	"/": 10,
-	"*": 10,
-	"-": 5,
-	"+": 5,
-	"=": 0,
+	"^":  15,
+	"/":  10,
+	"*":  10,
+	"-":  5,
+	"+":  5,
+	"=":  0,
+	"<>": 0,
+	"!=": 0,
+	"<":  0,
+	"<=": 0,
+	">":  0,
+	">=": 0,
+	"&&": -5,
+	"||": -10,
 }
 
+// operators listed here group right to left, all others group left to right
+var rightAssociative map[string]bool = map[string]bool{
+	"^": true,
+}
+
+// prefixPrecedence binds prefix negation tighter than every binary operator
+const prefixPrecedence = 100
+
+// atomPrecedence is used for anything that never needs parentheses: literals, fields and calls
+const atomPrecedence = 1000
+
 var DefaultEnv *Env = &Env{
 	Values: map[string]interface{}{
-		"SUMIF": func(ts []Token) (t Token, e error) {
-			defer func() {
-				if recover() != nil {
-					e = errors.New("Field for SUMIF is not a number or received a bad filter")
-				}
-			}()
-			var f float64 = 0
-			filter := ts[len(ts)-1].Value.([]Token)
-			for idx, t := range ts[:len(ts)-1] {
-				if !filter[idx].Value.(bool) {
-					continue
-				}
-				f += t.Value.(float64)
-			}
-			return *(&Token{
-				Type:  Static,
-				Value: f,
-			}), nil
-		},
-		"SUM": func(ts []Token) (t Token, e error) {
-			defer func() {
-				if recover() != nil {
-					e = errors.New("Field for SUM is not a number")
-				}
-			}()
-			var f float64 = 0
-			for _, t := range ts {
-				f += t.Value.(float64)
-			}
-			return *(&Token{
-				Type:  Static,
-				Value: f,
-			}), nil
-		},
-		"CONCAT": func(t []Token) (interface{}, error) {
-			return nil, nil
-		},
-		"=": func(ts []Token) (Token, error) {
-			l := len(ts) - 1
-			var rts []Token = make([]Token, 0)
-			last := ts[l].Value
-			var floatVal float64
-			floatCmp := false
-			switch last.(type) {
-			case float64:
-				floatVal = last.(float64)
-				floatCmp = true
-			}
-			for i := 0; i < l; i++ {
-				cVal := ts[i].Value
-				if floatCmp {
-					switch cVal.(type) {
-					case float64:
-						if math.Abs(cVal.(float64)-floatVal) < .00001 {
-							rts = append(rts, *(&Token{
-								Value: true,
-								Type:  Static,
-							}))
-						} else {
-							rts = append(rts, *(&Token{
-								Value: false,
-								Type:  Static,
-							}))
-						}
-						continue
-					}
-				}
-				if fmt.Sprint(cVal) == fmt.Sprint(last) {
-					rts = append(rts, *(&Token{
-						Value: true,
-						Type:  Static,
-					}))
-				} else {
-					rts = append(rts, *(&Token{
-						Value: false,
-						Type:  Static,
-					}))
-				}
-			}
-			if l == 1 {
-				return rts[0], nil
-			}
-			return *(&Token{
-				Value: rts,
-				Type:  Scope,
-			}), nil
-		},
-		">": func(ts []Token) (Token, error) {
-			l := len(ts) - 1
-			var rts []Token = make([]Token, 0)
-			b := ts[l].Value
-			strcmp := true
-			switch b.(type) {
-			case float64:
-				strcmp = false
-			}
-			for i := 0; i < l; i++ {
-				a := ts[i].Value
-				if !strcmp {
-					switch a.(type) {
-					case float64:
-						if a.(float64) > b.(float64) {
-							rts = append(rts, *(&Token{
-								Value: true,
-								Type:  Static,
-							}))
-						} else {
-							rts = append(rts, *(&Token{
-								Value: false,
-								Type:  Static,
-							}))
-						}
-						continue
-					}
-				}
-				if fmt.Sprint(b) > fmt.Sprint(a) {
-					rts = append(rts, *(&Token{
-						Value: true,
-						Type:  Static,
-					}))
-				} else {
-					rts = append(rts, *(&Token{
-						Value: false,
-						Type:  Static,
-					}))
-				}
-			}
-			return *(&Token{
-				Value: rts,
-				Type:  Scope,
-			}), nil
-		},
-		"*": func(ts []Token) (t Token, e error) {
-			defer func() {
-				if recover() != nil {
-					e = errors.New("Field for * is not a number")
-				}
-			}()
-			f := ts[0].Value.(float64)
-			for _, t := range ts[1:] {
-				f *= t.Value.(float64)
-			}
-			return *(&Token{
-				Value: f,
-				Type:  Static,
-			}), nil
-		},
-		"/": func(ts []Token) (t Token, e error) {
-			defer func() {
-				if recover() != nil {
-					e = errors.New("Field for / is not a number")
-				}
-			}()
-			f := ts[0].Value.(float64)
-			for _, t := range ts[1:] {
-				f /= t.Value.(float64)
-			}
-			return *(&Token{
-				Value: f,
-				Type:  Static,
-			}), nil
-		},
-		"+": func(ts []Token) (Token, error) {
-			// Degradation float64 -> string
-			stillf := true
-			hadf := false
-			var f float64
-			var s string = ""
-			for _, t := range ts {
-				switch v := t.Value.(type) {
-				default:
-					if stillf {
-						stillf = false
-						if hadf {
-							s += fmt.Sprintf("%0.000f", f)
-						}
-					}
-					s += fmt.Sprint(v)
-				case float64:
-					if stillf {
-						if !hadf {
-							f = v
-							hadf = true
-						} else {
-							f += v
-						}
-					} else {
-						s += fmt.Sprintf("%0.000f", v)
-					}
-				}
-			}
-			var rv interface{}
-			if stillf {
-				rv = f
-			} else {
-				rv = s
-			}
-			return *(&Token{
-				Value: rv,
-				Type:  Static,
-			}), nil
+		"SUMIF": &FunctionDef{
+			Name:    "SUMIF",
+			MinArgs: 2,
+			MaxArgs: 3,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnSumIf,
+		},
+		"SUMIFS": &FunctionDef{
+			Name:     "SUMIFS",
+			MinArgs:  3,
+			MaxArgs:  Variadic,
+			Args:     []ArgKind{AnyArg},
+			Fn:       fnSumIfs,
+			Validate: pairedArgs(1, "range and criteria"),
+		},
+		"COUNTIF": &FunctionDef{
+			Name:    "COUNTIF",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnCountIf,
+		},
+		"COUNTIFS": &FunctionDef{
+			Name:     "COUNTIFS",
+			MinArgs:  2,
+			MaxArgs:  Variadic,
+			Args:     []ArgKind{AnyArg},
+			Fn:       fnCountIfs,
+			Validate: pairedArgs(0, "range and criteria"),
+		},
+		"AVERAGEIF": &FunctionDef{
+			Name:    "AVERAGEIF",
+			MinArgs: 2,
+			MaxArgs: 3,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnAverageIf,
+		},
+		"AVERAGEIFS": &FunctionDef{
+			Name:     "AVERAGEIFS",
+			MinArgs:  3,
+			MaxArgs:  Variadic,
+			Args:     []ArgKind{AnyArg},
+			Fn:       fnAverageIfs,
+			Validate: pairedArgs(1, "range and criteria"),
+		},
+		"MAXIFS": &FunctionDef{
+			Name:     "MAXIFS",
+			MinArgs:  3,
+			MaxArgs:  Variadic,
+			Args:     []ArgKind{AnyArg},
+			Fn:       fnMaxIfs,
+			Validate: pairedArgs(1, "range and criteria"),
+		},
+		"MINIFS": &FunctionDef{
+			Name:     "MINIFS",
+			MinArgs:  3,
+			MaxArgs:  Variadic,
+			Args:     []ArgKind{AnyArg},
+			Fn:       fnMinIfs,
+			Validate: pairedArgs(1, "range and criteria"),
+		},
+		"SUM": &FunctionDef{
+			Name:    "SUM",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnSum,
+		},
+		"AVERAGE": &FunctionDef{
+			Name:    "AVERAGE",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnAverage,
+		},
+		"MIN": &FunctionDef{
+			Name:    "MIN",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnMin,
+		},
+		"MAX": &FunctionDef{
+			Name:    "MAX",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnMax,
+		},
+		"PRODUCT": &FunctionDef{
+			Name:    "PRODUCT",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnProduct,
+		},
+		"MEDIAN": &FunctionDef{
+			Name:    "MEDIAN",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnMedian,
+		},
+		"MODE": &FunctionDef{
+			Name:    "MODE",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnMode,
+		},
+		"STDEV": &FunctionDef{
+			Name:    "STDEV",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnStdev,
+		},
+		"VAR": &FunctionDef{
+			Name:    "VAR",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnVar,
+		},
+		"COUNT": &FunctionDef{
+			Name:    "COUNT",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnCount,
+		},
+		"COUNTA": &FunctionDef{
+			Name:    "COUNTA",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnCountA,
+		},
+		"COUNTBLANK": &FunctionDef{
+			Name:    "COUNTBLANK",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnCountBlank,
+		},
+		"CONCAT": &FunctionDef{
+			Name:    "CONCAT",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnConcat,
+		},
+		"ROUND": &FunctionDef{
+			Name:    "ROUND",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnRound,
+		},
+		"ROUNDUP": &FunctionDef{
+			Name:    "ROUNDUP",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnRoundUp,
+		},
+		"ROUNDDOWN": &FunctionDef{
+			Name:    "ROUNDDOWN",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnRoundDown,
+		},
+		"TRUNC": &FunctionDef{
+			Name:    "TRUNC",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnTrunc,
+		},
+		"FLOOR": &FunctionDef{
+			Name:    "FLOOR",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnFloor,
+		},
+		"CEILING": &FunctionDef{
+			Name:    "CEILING",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnCeiling,
+		},
+		"ABS": &FunctionDef{
+			Name:    "ABS",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnAbs,
+		},
+		"SIGN": &FunctionDef{
+			Name:    "SIGN",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnSign,
+		},
+		"MOD": &FunctionDef{
+			Name:    "MOD",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnMod,
+		},
+		"POWER": &FunctionDef{
+			Name:    "POWER",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnPower,
+		},
+		"SQRT": &FunctionDef{
+			Name:    "SQRT",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnSqrt,
+		},
+		"EXP": &FunctionDef{
+			Name:    "EXP",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnExp,
+		},
+		"LN": &FunctionDef{
+			Name:    "LN",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnLn,
+		},
+		"LOG10": &FunctionDef{
+			Name:    "LOG10",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      fnLog10,
+		},
+		"TEXTJOIN": &FunctionDef{
+			Name:    "TEXTJOIN",
+			MinArgs: 3,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnTextJoin,
+		},
+		"LEN": &FunctionDef{
+			Name:    "LEN",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnLen,
+		},
+		"LEFT": &FunctionDef{
+			Name:    "LEFT",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg, NumberArg | ListArg},
+			Fn:      fnLeft,
+		},
+		"RIGHT": &FunctionDef{
+			Name:    "RIGHT",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg, NumberArg | ListArg},
+			Fn:      fnRight,
+		},
+		"MID": &FunctionDef{
+			Name:    "MID",
+			MinArgs: 3,
+			MaxArgs: 3,
+			Args:    []ArgKind{AnyArg, NumberArg | ListArg},
+			Fn:      fnMid,
+		},
+		"UPPER": &FunctionDef{
+			Name:    "UPPER",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnUpper,
+		},
+		"LOWER": &FunctionDef{
+			Name:    "LOWER",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnLower,
+		},
+		"PROPER": &FunctionDef{
+			Name:    "PROPER",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnProper,
+		},
+		"TRIM": &FunctionDef{
+			Name:    "TRIM",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnTrim,
+		},
+		"SUBSTITUTE": &FunctionDef{
+			Name:    "SUBSTITUTE",
+			MinArgs: 3,
+			MaxArgs: 4,
+			Args:    []ArgKind{AnyArg, AnyArg, AnyArg, NumberArg | ListArg},
+			Fn:      fnSubstitute,
+		},
+		"REPLACE": &FunctionDef{
+			Name:    "REPLACE",
+			MinArgs: 4,
+			MaxArgs: 4,
+			Args:    []ArgKind{AnyArg, NumberArg | ListArg, NumberArg | ListArg, AnyArg},
+			Fn:      fnReplace,
+		},
+		"FIND": &FunctionDef{
+			Name:    "FIND",
+			MinArgs: 2,
+			MaxArgs: 3,
+			Args:    []ArgKind{AnyArg, AnyArg, NumberArg | ListArg},
+			Fn:      fnFind,
+		},
+		"SEARCH": &FunctionDef{
+			Name:    "SEARCH",
+			MinArgs: 2,
+			MaxArgs: 3,
+			Args:    []ArgKind{AnyArg, AnyArg, NumberArg | ListArg},
+			Fn:      fnSearch,
+		},
+		"REPT": &FunctionDef{
+			Name:    "REPT",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg, NumberArg | ListArg},
+			Fn:      fnRept,
+		},
+		"EXACT": &FunctionDef{
+			Name:    "EXACT",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnExact,
+		},
+		"NULL": &FunctionDef{
+			Name:    "NULL",
+			MinArgs: 0,
+			MaxArgs: 0,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnNull,
+		},
+		"BLANK": &FunctionDef{
+			Name:    "BLANK",
+			MinArgs: 0,
+			MaxArgs: 0,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnNull,
+		},
+		"ISBLANK": &FunctionDef{
+			Name:    "ISBLANK",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnIsBlank,
+		},
+		"ISNUMBER": &FunctionDef{
+			Name:    "ISNUMBER",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnIsNumber,
+		},
+		"ISTEXT": &FunctionDef{
+			Name:    "ISTEXT",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnIsText,
+		},
+		"ISLOGICAL": &FunctionDef{
+			Name:    "ISLOGICAL",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnIsLogical,
+		},
+		"AND": &FunctionDef{
+			Name:    "AND",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{AnyArg},
+			Lazy:    fnAnd,
+		},
+		"OR": &FunctionDef{
+			Name:    "OR",
+			MinArgs: 1,
+			MaxArgs: Variadic,
+			Args:    []ArgKind{AnyArg},
+			Lazy:    fnOr,
+		},
+		"NOT": &FunctionDef{
+			Name:    "NOT",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Args:    []ArgKind{AnyArg},
+			Fn:      fnNot,
+		},
+		"IF": &FunctionDef{
+			Name:    "IF",
+			MinArgs: 2,
+			MaxArgs: 3,
+			Args:    []ArgKind{AnyArg},
+			Lazy:    fnIf,
+		},
+		"IFS": &FunctionDef{
+			Name:     "IFS",
+			MinArgs:  2,
+			MaxArgs:  Variadic,
+			Args:     []ArgKind{AnyArg},
+			Lazy:     fnIfs,
+			Validate: pairedArgs(0, "condition and value"),
+		},
+		"&&": &FunctionDef{
+			Name:    "&&",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg},
+			Lazy:    opAnd,
+		},
+		"||": &FunctionDef{
+			Name:    "||",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg},
+			Lazy:    opOr,
+		},
+		"=": &FunctionDef{
+			Name:    "=",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg},
+			Fn:      opEqual,
+		},
+		"<>": &FunctionDef{
+			Name:    "<>",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg},
+			Fn:      opNotEqual,
+		},
+		"!=": &FunctionDef{
+			Name:    "!=",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg},
+			Fn:      opNotEqual,
+		},
+		"<": &FunctionDef{
+			Name:    "<",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg},
+			Fn:      opLess,
+		},
+		"<=": &FunctionDef{
+			Name:    "<=",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg},
+			Fn:      opLessEqual,
+		},
+		">": &FunctionDef{
+			Name:    ">",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg},
+			Fn:      opGreater,
+		},
+		">=": &FunctionDef{
+			Name:    ">=",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg},
+			Fn:      opGreaterEqual,
+		},
+		"*": &FunctionDef{
+			Name:    "*",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      opMultiply,
+		},
+		"/": &FunctionDef{
+			Name:    "/",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      opDivide,
+		},
+		"-": &FunctionDef{
+			Name:    "-",
+			MinArgs: 1,
+			MaxArgs: 2,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      opSubtract,
+		},
+		"^": &FunctionDef{
+			Name:    "^",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{NumberArg | ListArg},
+			Fn:      opPower,
+		},
+		"+": &FunctionDef{
+			Name:    "+",
+			MinArgs: 2,
+			MaxArgs: 2,
+			Args:    []ArgKind{AnyArg},
+			Fn:      opAdd,
 		},
 	},
 }
 
 type Evaluator struct {
 	Tokens, fields []Token
+
+	env      *Env
+	exact    bool
+	rounding *rounding
+	resolver resolver
 }
 
 // INTERFACES
@@ -253,11 +639,13 @@ type Evaluatorizer interface {
 	Parse(string) error
 	Run(...interface{}) ([]interface{}, error)
 	AST() string
+	Tree() Node
+	Load(Node) error
+	Format() string
 	AppliesTo(...interface{}) (bool, error)
 
 	tokenize(_ string) error
 	run([]Token, ...interface{}) ([]interface{}, error)
-	ast([]Token, int) string
 }
 
 var _ Evaluatorizer = (*Evaluator)(nil)
@@ -0,0 +1,327 @@
+package fieldcalculator
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// criterion is a spreadsheet style condition like 10, ">10", "<>Prod 2" or "Prod*"
+type criterion struct {
+	op string
+	// number is set when the operand reads as a number, pattern when it is text
+	number  interface{}
+	text    string
+	pattern *regexp.Regexp
+	value   interface{}
+}
+
+// criterionOps is checked in order so two character operators win over their prefixes
+var criterionOps = []string{"<=", ">=", "<>", "<", ">", "="}
+
+// parseCriterion reads a criteria argument, only strings carry an operator and wildcards
+func parseCriterion(v interface{}) criterion {
+	s, ok := v.(string)
+	if !ok {
+		return criterion{op: "=", value: v, number: numberOrNil(v)}
+	}
+	c := criterion{op: "="}
+	for _, op := range criterionOps {
+		if strings.HasPrefix(s, op) {
+			c.op, s = op, s[len(op):]
+			break
+		}
+	}
+	c.text = s
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		c.number = i
+	} else if f, err := strconv.ParseFloat(s, 64); err == nil {
+		c.number = f
+	} else {
+		c.pattern = wildcardPattern(s)
+	}
+	return c
+}
+
+func numberOrNil(v interface{}) interface{} {
+	if isNumber(v) {
+		return v
+	}
+	return nil
+}
+
+// wildcardPattern turns * and ? into a case insensitive regexp matching all of s
+func wildcardPattern(s string) *regexp.Regexp {
+	return regexp.MustCompile("(?is)^" + wildcardExpr(s) + "$")
+}
+
+// wildcardExpr is the regexp for s where * and ? are wildcards and ~ escapes the next character
+func wildcardExpr(s string) string {
+	var b strings.Builder
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '~':
+			escaped = true
+		case r == '*':
+			b.WriteString(".*")
+		case r == '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if escaped {
+		b.WriteString("~")
+	}
+	return b.String()
+}
+
+// match tests one value of a criteria range
+func (c criterion) match(v interface{}) bool {
+	var cmp int
+	switch {
+	case c.number != nil:
+		if !isNumber(v) {
+			if s, ok := v.(string); ok && c.op == "=" {
+				return strings.TrimSpace(s) == c.text
+			}
+			return c.op == "<>"
+		}
+		switch c.op {
+		case "=":
+			return equalNumbers(v, c.number)
+		case "<>":
+			return !equalNumbers(v, c.number)
+		}
+		cmp = compareNumbers(v, c.number)
+	case c.pattern != nil:
+		s, ok := v.(string)
+		if v == nil {
+			s, ok = "", true
+		}
+		if !ok {
+			return c.op == "<>"
+		}
+		switch c.op {
+		case "=":
+			return c.pattern.MatchString(s)
+		case "<>":
+			return !c.pattern.MatchString(s)
+		}
+		cmp = strings.Compare(strings.ToLower(s), strings.ToLower(c.text))
+	default:
+		// booleans and blanks only compare equal, DeepEqual as values from documents may be maps or slices
+		eq := reflect.DeepEqual(v, c.value)
+		if c.op == "<>" {
+			return !eq
+		}
+		return eq && c.op == "="
+	}
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "<>":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	}
+	return cmp >= 0
+}
+
+// selectIfs keeps the values of the argument at valuesIdx for which every (range, criteria) pair
+// in the arguments from pairsIdx up to pairsEnd matches, every range has to be as long as the values
+func selectIfs(fn string, ts []Token, valuesIdx, pairsIdx, pairsEnd int) ([]Token, error) {
+	values := flattenTokens(ts[valuesIdx : valuesIdx+1])
+	if (pairsEnd-pairsIdx)%2 != 0 {
+		return nil, errors.New(fmt.Sprintf("%s expects pairs of range and criteria", fn))
+	}
+	keep := make([]bool, len(values))
+	for i := range keep {
+		keep[i] = true
+	}
+	for i := pairsIdx; i < pairsEnd; i += 2 {
+		rng := flattenTokens(ts[i : i+1])
+		if len(rng) != len(values) {
+			return nil, argError(i, ts[i].Value, fmt.Sprintf("%s range has %d entries, expected %d", fn, len(rng), len(values)))
+		}
+		if ts[i+1].Type == Scope {
+			return nil, argError(i+1, ts[i+1].Value, fmt.Sprintf("%s criteria must be a single value", fn))
+		}
+		c := parseCriterion(ts[i+1].Value)
+		for j, t := range rng {
+			keep[j] = keep[j] && c.match(t.Value)
+		}
+	}
+	selected := make([]Token, 0)
+	for i, t := range values {
+		if keep[i] {
+			selected = append(selected, t)
+		}
+	}
+	return selected, nil
+}
+
+// selectNumbers is selectIfs for aggregates, floats reports whether the whole values column held floats
+func selectNumbers(fn string, ts []Token, valuesIdx, pairsIdx, pairsEnd int) ([]interface{}, bool, error) {
+	floats := false
+	for _, t := range flattenTokens(ts[valuesIdx : valuesIdx+1]) {
+		if _, ok := t.Value.(float64); ok {
+			floats = true
+		}
+	}
+	selected, err := selectIfs(fn, ts, valuesIdx, pairsIdx, pairsEnd)
+	if err != nil {
+		return nil, false, err
+	}
+	numbers := make([]interface{}, 0, len(selected))
+	for _, t := range selected {
+		if t.Value == nil {
+			continue
+		}
+		if !isNumber(t.Value) {
+			return nil, false, argError(valuesIdx, t.Value, fmt.Sprintf("Field for %s is not a number", fn))
+		}
+		numbers = append(numbers, t.Value)
+	}
+	return numbers, floats, nil
+}
+
+// isMask reports whether t is a boolean or a list of booleans, the filter form SUMIF took before criteria
+func isMask(t Token) bool {
+	for _, x := range flattenTokens([]Token{t}) {
+		if _, ok := x.Value.(bool); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// fnSumIf is SUMIF(range, criteria[, sum_range]), SUMIF(values, [values] > 2) still filters by a list of booleans
+func fnSumIf(ts []Token) (Token, error) {
+	if len(ts) == 2 && isMask(ts[1]) {
+		return sumIfMask(ts)
+	}
+	valuesIdx := 0
+	if len(ts) == 3 {
+		valuesIdx = 2
+	}
+	numbers, floats, err := selectNumbers("SUMIF", ts, valuesIdx, 0, 2)
+	if err != nil {
+		return *(&Token{}), err
+	}
+	return staticToken(sumNumbers(numbers, floats)), nil
+}
+
+func sumIfMask(ts []Token) (Token, error) {
+	values := flattenTokens(ts[:1])
+	filter := flattenTokens(ts[1:])
+	if len(filter) != 1 && len(filter) != len(values) {
+		return *(&Token{}), errors.New(fmt.Sprintf("SUMIF filter has %d entries for %d values", len(filter), len(values)))
+	}
+	matched := make([]interface{}, 0)
+	floats := false
+	for idx, t := range values {
+		m := filter[0]
+		if len(filter) > 1 {
+			m = filter[idx]
+		}
+		b, ok := m.Value.(bool)
+		if !ok {
+			return *(&Token{}), argError(1, m.Value, "SUMIF received a bad filter")
+		}
+		if t.Value == nil {
+			continue
+		}
+		if !isNumber(t.Value) {
+			return *(&Token{}), argError(0, t.Value, "Field for SUMIF is not a number")
+		}
+		if _, ok := t.Value.(float64); ok {
+			floats = true
+		}
+		if b {
+			matched = append(matched, t.Value)
+		}
+	}
+	return staticToken(sumNumbers(matched, floats)), nil
+}
+
+// ifsAggregate builds the *IFS functions taking the aggregated range first and range/criteria pairs after it
+func ifsAggregate(fn string, f func([]interface{}, bool) (interface{}, error)) func([]Token) (Token, error) {
+	return func(ts []Token) (Token, error) {
+		numbers, floats, err := selectNumbers(fn, ts, 0, 1, len(ts))
+		if err != nil {
+			return *(&Token{}), err
+		}
+		v, err := f(numbers, floats)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		return staticToken(v), nil
+	}
+}
+
+func averageOf(fn string) func([]interface{}, bool) (interface{}, error) {
+	return func(numbers []interface{}, _ bool) (interface{}, error) {
+		if len(numbers) == 0 {
+			return nil, errors.New(fmt.Sprintf("%s matched no numbers", fn))
+		}
+		return average(numbers), nil
+	}
+}
+
+var (
+	fnSumIfs = ifsAggregate("SUMIFS", func(numbers []interface{}, floats bool) (interface{}, error) {
+		return sumNumbers(numbers, floats), nil
+	})
+	fnAverageIfs = ifsAggregate("AVERAGEIFS", averageOf("AVERAGEIFS"))
+	fnMaxIfs     = ifsAggregate("MAXIFS", func(numbers []interface{}, _ bool) (interface{}, error) {
+		return extreme(numbers, func(c int) bool { return c > 0 }), nil
+	})
+	fnMinIfs = ifsAggregate("MINIFS", func(numbers []interface{}, _ bool) (interface{}, error) {
+		return extreme(numbers, func(c int) bool { return c < 0 }), nil
+	})
+)
+
+// fnAverageIf is AVERAGEIF(range, criteria[, average_range])
+func fnAverageIf(ts []Token) (Token, error) {
+	valuesIdx := 0
+	if len(ts) == 3 {
+		valuesIdx = 2
+	}
+	numbers, _, err := selectNumbers("AVERAGEIF", ts, valuesIdx, 0, 2)
+	if err != nil {
+		return *(&Token{}), err
+	}
+	v, err := averageOf("AVERAGEIF")(numbers, false)
+	if err != nil {
+		return *(&Token{}), err
+	}
+	return staticToken(v), nil
+}
+
+// countIfs counts the entries of the first range matching every pair, COUNTIF is the single pair form
+func countIfs(fn string) func([]Token) (Token, error) {
+	return func(ts []Token) (Token, error) {
+		selected, err := selectIfs(fn, ts, 0, 0, len(ts))
+		if err != nil {
+			return *(&Token{}), err
+		}
+		return staticToken(int64(len(selected))), nil
+	}
+}
+
+var (
+	fnCountIf  = countIfs("COUNTIF")
+	fnCountIfs = countIfs("COUNTIFS")
+)
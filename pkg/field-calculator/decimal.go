@@ -0,0 +1,224 @@
+package fieldcalculator
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// RoundingMode picks how a value between two decimal places is rounded
+type RoundingMode uint8
+
+const (
+	// RoundHalfUp rounds halves away from zero, 2.5 -> 3 and -2.5 -> -3
+	RoundHalfUp RoundingMode = iota
+	// RoundHalfEven rounds halves to the even neighbour, 2.5 -> 2 and 3.5 -> 4
+	RoundHalfEven
+	// RoundUp rounds away from zero
+	RoundUp
+	// RoundDown rounds towards zero
+	RoundDown
+	// RoundCeiling rounds towards positive infinity
+	RoundCeiling
+	// RoundFloor rounds towards negative infinity
+	RoundFloor
+)
+
+// WithExactDecimals makes the evaluator parse numeric literals and read numeric fields as *big.Rat,
+// so + - * /, comparisons and aggregates are exact. Numbers in the results are *big.Rat.
+func WithExactDecimals() ParserOption {
+	return func(ev *Evaluator) {
+		ev.exact = true
+	}
+}
+
+// WithRounding rounds decimal and float results of Run to places decimal places using mode
+func WithRounding(places int, mode RoundingMode) ParserOption {
+	return func(ev *Evaluator) {
+		ev.rounding = &rounding{places: places, mode: mode}
+	}
+}
+
+type rounding struct {
+	places int
+	mode   RoundingMode
+}
+
+// toRat reads any numeric value as a *big.Rat, floats are taken at the shortest decimal that
+// prints them so a float64 field holding 1.11 becomes exactly 111/100
+func toRat(v interface{}) (*big.Rat, bool) {
+	switch n := v.(type) {
+	case *big.Rat:
+		return n, n != nil
+	case json.Number:
+		return new(big.Rat).SetString(string(n))
+	case *big.Int:
+		if n == nil {
+			return nil, false
+		}
+		return new(big.Rat).SetInt(n), true
+	case *big.Float:
+		if n == nil || n.IsInf() {
+			return nil, false
+		}
+		r, _ := n.Rat(nil)
+		return r, true
+	case fmt.Stringer:
+		// decimal types print their exact value
+		if _, ok := v.(decimalFloat); ok {
+			if r, ok := new(big.Rat).SetString(n.String()); ok {
+				return r, true
+			}
+		}
+	}
+	switch n := coerceNumber(v).(type) {
+	case int64:
+		return new(big.Rat).SetInt64(n), true
+	case float64:
+		if math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, false
+		}
+		return new(big.Rat).SetString(strconv.FormatFloat(n, 'g', -1, 64))
+	}
+	return nil, false
+}
+
+// bothRats returns a and b as *big.Rat when one of them already is one
+func bothRats(a, b interface{}) (*big.Rat, *big.Rat, bool) {
+	_, aok := a.(*big.Rat)
+	_, bok := b.(*big.Rat)
+	if !aok && !bok {
+		return nil, nil, false
+	}
+	ar, aok := toRat(a)
+	br, bok := toRat(b)
+	return ar, br, aok && bok
+}
+
+// roundRat rounds r to places decimal places, a negative places rounds to tens, hundreds, ...
+func roundRat(r *big.Rat, places int, mode RoundingMode) *big.Rat {
+	exp := places
+	if exp < 0 {
+		exp = -exp
+	}
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+	if places < 0 {
+		scale.Inv(scale)
+	}
+	x := new(big.Rat).Mul(r, scale)
+	q, rem := new(big.Int).QuoRem(x.Num(), x.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		// twice the remainder against the denominator tells whether we are below, at or past half
+		twice := new(big.Int).Lsh(new(big.Int).Abs(rem), 1)
+		half := twice.Cmp(x.Denom())
+		neg := x.Sign() < 0
+		away := false
+		switch mode {
+		case RoundHalfUp:
+			away = half >= 0
+		case RoundHalfEven:
+			away = half > 0 || (half == 0 && q.Bit(0) == 1)
+		case RoundUp:
+			away = true
+		case RoundCeiling:
+			away = !neg
+		case RoundFloor:
+			away = neg
+		}
+		if away && neg {
+			q.Sub(q, big.NewInt(1))
+		} else if away {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return new(big.Rat).Quo(new(big.Rat).SetInt(q), scale)
+}
+
+// decimalString prints r as a plain decimal when it has a finite expansion and as a/b otherwise
+func decimalString(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+	d := new(big.Int).Set(r.Denom())
+	twos, fives := 0, 0
+	for d.Bit(0) == 0 {
+		d.Rsh(d, 1)
+		twos++
+	}
+	five, m := big.NewInt(5), new(big.Int)
+	for {
+		q, rem := new(big.Int).QuoRem(d, five, m)
+		if rem.Sign() != 0 {
+			break
+		}
+		d = q
+		fives++
+	}
+	if d.Cmp(big.NewInt(1)) != 0 {
+		return r.RatString()
+	}
+	if fives > twos {
+		twos = fives
+	}
+	return r.FloatString(twos)
+}
+
+// coerceValue normalizes a number for the evaluator, exact evaluators keep every number as a *big.Rat
+func (ev *Evaluator) coerceValue(v interface{}) interface{} {
+	if ev.exact {
+		if r, ok := toRat(v); ok {
+			return r
+		}
+		return v
+	}
+	return coerceNumber(v)
+}
+
+// coerceToken normalizes the numbers held by a token or a list of tokens
+func (ev *Evaluator) coerceToken(t Token) Token {
+	switch t.Type {
+	case Scope:
+		ts := t.Value.([]Token)
+		rts := make([]Token, 0, len(ts))
+		for _, x := range ts {
+			rts = append(rts, ev.coerceToken(x))
+		}
+		t.Value = rts
+	case FuncScope:
+		ts := t.Value.([]Token)
+		rts := append(make([]Token, 0, len(ts)), ts[0])
+		for _, x := range ts[1:] {
+			rts = append(rts, ev.coerceToken(x))
+		}
+		t.Value = rts
+	case Static:
+		if isNumber(t.Value) {
+			t.Value = ev.coerceValue(t.Value)
+		}
+	}
+	return t
+}
+
+// output applies the configured rounding to a result
+func (ev *Evaluator) output(v interface{}) interface{} {
+	switch x := v.(type) {
+	case []interface{}:
+		rs := make([]interface{}, 0, len(x))
+		for _, r := range x {
+			rs = append(rs, ev.output(r))
+		}
+		return rs
+	case *big.Rat:
+		if ev.rounding != nil {
+			return roundRat(x, ev.rounding.places, ev.rounding.mode)
+		}
+	case float64:
+		if r, ok := toRat(x); ok && ev.rounding != nil {
+			f, _ := roundRat(r, ev.rounding.places, ev.rounding.mode).Float64()
+			return f
+		}
+	}
+	return v
+}
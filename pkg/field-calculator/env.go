@@ -0,0 +1,183 @@
+package fieldcalculator
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// NewEnv creates an empty environment, lookups that miss fall through to parent
+func NewEnv(parent *Env) *Env {
+	return &Env{
+		Values: make(map[string]interface{}),
+		Parent: parent,
+	}
+}
+
+// Lookup finds name in this environment or the closest parent defining it
+func (e *Env) Lookup(name string) (interface{}, bool) {
+	name = strings.ToUpper(name)
+	for env := e; env != nil; env = env.Parent {
+		env.mu.RLock()
+		v, ok := env.Values[name]
+		env.mu.RUnlock()
+		if ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// Set defines name in this environment, shadowing any parent definition
+func (e *Env) Set(name string, v interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.Values == nil {
+		e.Values = make(map[string]interface{})
+	}
+	e.Values[strings.ToUpper(name)] = v
+}
+
+// RegisterFunction defines a typed function, Parse checks calls against its arity and argument kinds
+//
+//	maxArgs: Variadic to accept any number of arguments
+//	kinds:   accepted kinds per argument, the last one repeats, nil accepts anything
+func (e *Env) RegisterFunction(name string, minArgs, maxArgs int, kinds []ArgKind, fn func([]Token) (Token, error)) error {
+	if name == "" {
+		return errors.New("Function name is required")
+	}
+	if fn == nil {
+		return errors.New(fmt.Sprintf("Function %s has no implementation", name))
+	}
+	if err := checkSignature(name, minArgs, maxArgs); err != nil {
+		return err
+	}
+	e.Set(name, &FunctionDef{
+		Name:    strings.ToUpper(name),
+		MinArgs: minArgs,
+		MaxArgs: maxArgs,
+		Args:    kinds,
+		Fn:      fn,
+	})
+	return nil
+}
+
+// RegisterLazyFunction defines a typed function that receives its arguments unevaluated,
+// only the thunks it calls are run so untaken branches never fail
+func (e *Env) RegisterLazyFunction(name string, minArgs, maxArgs int, kinds []ArgKind, fn func([]Thunk) (Token, error)) error {
+	if name == "" {
+		return errors.New("Function name is required")
+	}
+	if fn == nil {
+		return errors.New(fmt.Sprintf("Function %s has no implementation", name))
+	}
+	if err := checkSignature(name, minArgs, maxArgs); err != nil {
+		return err
+	}
+	e.Set(name, &FunctionDef{
+		Name:    strings.ToUpper(name),
+		MinArgs: minArgs,
+		MaxArgs: maxArgs,
+		Args:    kinds,
+		Lazy:    fn,
+	})
+	return nil
+}
+
+func checkSignature(name string, minArgs, maxArgs int) error {
+	if minArgs < 0 || (maxArgs != Variadic && maxArgs < minArgs) {
+		return errors.New(fmt.Sprintf("Function %s has an invalid arity (%d, %d)", name, minArgs, maxArgs))
+	}
+	return nil
+}
+
+// kind returns the accepted kinds for the argument at idx
+func (f *FunctionDef) kind(idx int) ArgKind {
+	if len(f.Args) == 0 {
+		return AnyArg
+	}
+	if idx >= len(f.Args) {
+		return f.Args[len(f.Args)-1]
+	}
+	return f.Args[idx]
+}
+
+// checkArgs validates a call to f at parse time, only literals have a known kind before running
+func (f *FunctionDef) checkArgs(name Token, args []Token) *ParseError {
+	n := fmt.Sprint(name.Value)
+	if len(args) < f.MinArgs {
+		return &ParseError{
+			Message: fmt.Sprintf("%s expects at least %d argument(s), got %d", f.Name, f.MinArgs, len(args)),
+			Offset:  name.Position,
+			Token:   n,
+		}
+	}
+	if f.MaxArgs != Variadic && len(args) > f.MaxArgs {
+		return &ParseError{
+			Message: fmt.Sprintf("%s expects at most %d argument(s), got %d", f.Name, f.MaxArgs, len(args)),
+			Offset:  name.Position,
+			Token:   n,
+		}
+	}
+	for i, a := range args {
+		// parentheses around a literal do not change its kind
+		if a = unwrapScope(a); a.Type != Static {
+			continue
+		}
+		if k := literalKind(a.Value); f.kind(i)&k == 0 {
+			return &ParseError{
+				Message:  fmt.Sprintf("%s argument %d does not accept a %s", f.Name, i+1, k),
+				Offset:   a.Position,
+				Token:    fmt.Sprint(a.Value),
+				Expected: []string{f.kind(i).String()},
+			}
+		}
+	}
+	if f.Validate != nil {
+		if err := f.Validate(args); err != nil {
+			return &ParseError{
+				Message: err.Error(),
+				Offset:  name.Position,
+				Token:   n,
+			}
+		}
+	}
+	return nil
+}
+
+// pairedArgs is a Validate for functions taking the arguments from first on in pairs of what
+func pairedArgs(first int, what string) func([]Token) error {
+	return func(args []Token) error {
+		if (len(args)-first)%2 != 0 {
+			return errors.New(fmt.Sprintf("Expects pairs of %s, got %d argument(s)", what, len(args)))
+		}
+		return nil
+	}
+}
+
+// literalKind maps a literal value to its argument kind
+func literalKind(v interface{}) ArgKind {
+	switch v.(type) {
+	case int64, float64, *big.Rat:
+		return NumberArg
+	case bool:
+		return BoolArg
+	case string:
+		return StringArg
+	}
+	return AnyArg
+}
+
+func (k ArgKind) String() string {
+	names := make([]string, 0)
+	for _, n := range []struct {
+		kind ArgKind
+		name string
+	}{{NumberArg, "number"}, {StringArg, "string"}, {BoolArg, "bool"}, {ListArg, "list"}} {
+		if k&n.kind != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
@@ -0,0 +1,182 @@
+package fieldcalculator
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ParseError points at the part of a formula that could not be parsed
+type ParseError struct {
+	Message string
+	// Source is the formula being parsed, it is empty for errors found while loading an AST
+	Source string
+	// Offset is in bytes, Line and Column count from 1 and Column counts runes
+	Offset, Line, Column int
+	// Token is the offending source text, empty at the end of the formula
+	Token    string
+	Expected []string
+}
+
+// parseErrorAt builds a ParseError for the token found at offset idx of src
+func parseErrorAt(src string, idx int, token, msg string, expected ...string) *ParseError {
+	e := &ParseError{
+		Message:  msg,
+		Offset:   idx,
+		Token:    token,
+		Expected: expected,
+	}
+	return e.withSource(src)
+}
+
+// withSource resolves the line and column of the error within src
+func (e *ParseError) withSource(src string) *ParseError {
+	e.Source = src
+	if src == "" {
+		return e
+	}
+	if e.Offset > len(src) {
+		e.Offset = len(src)
+	}
+	e.Line, e.Column = 1, 1
+	for _, r := range src[:e.Offset] {
+		if r == '\n' {
+			e.Line++
+			e.Column = 1
+			continue
+		}
+		e.Column++
+	}
+	return e
+}
+
+// Error renders the message, the location and the source line with a caret under the offending token
+func (e *ParseError) Error() string {
+	msg := e.Message
+	if len(e.Expected) > 0 {
+		msg += ", expected " + strings.Join(e.Expected, " or ")
+	}
+	if e.Source == "" {
+		return msg + fmt.Sprintf(" @ offset %d", e.Offset)
+	}
+	msg += fmt.Sprintf(" @ line %d, character %d", e.Line, e.Column)
+	start := strings.LastIndex(e.Source[:e.Offset], "\n") + 1
+	end := strings.Index(e.Source[start:], "\n")
+	if end < 0 {
+		end = len(e.Source)
+	} else {
+		end += start
+	}
+	// keep tabs so the caret lines up however the line is displayed
+	pad := make([]rune, 0, e.Column)
+	for _, r := range e.Source[start:e.Offset] {
+		if r == '\t' {
+			pad = append(pad, '\t')
+		} else {
+			pad = append(pad, ' ')
+		}
+	}
+	return msg + "\n" + strings.TrimRight(e.Source[start:end], "\r") + "\n" + string(pad) + "^"
+}
+
+// tokenText describes a lexeme for error messages
+func tokenText(l lexeme) string {
+	if l.kind == lexEOF {
+		return "end of formula"
+	}
+	return "'" + l.text + "'"
+}
+
+// runeAt returns the single character starting at idx
+func runeAt(s string, idx int) string {
+	_, size := utf8.DecodeRuneInString(s[idx:])
+	return s[idx : idx+size]
+}
+
+// EvalError describes a failure while running a formula, use errors.As to inspect it
+type EvalError struct {
+	Message string
+	// Func is the function or operator that failed, empty when a field could not be read
+	Func string
+	// ArgIndex counts arguments of Func from 0, -1 when the failure is not tied to one
+	ArgIndex int
+	// GoType is the Go type of the offending value
+	GoType string
+	// Path is the field path the offending value came from
+	Path string
+	// Position is the source offset of the offending argument, field or call
+	Position int
+	// Record is the index of the value passed to Run, -1 when unknown
+	Record int
+	// Err is the error a function returned, if it was not an EvalError itself
+	Err error
+
+	located bool
+}
+
+// argError blames the argument at idx of the running function for holding v
+func argError(idx int, v interface{}, msg string) *EvalError {
+	return &EvalError{
+		Message:  msg,
+		ArgIndex: idx,
+		GoType:   fmt.Sprintf("%T", v),
+		Record:   -1,
+	}
+}
+
+// locate fills in the call an error came from, errors already located by a nested call are kept
+func locate(err error, call Token) error {
+	ee, ok := err.(*EvalError)
+	if !ok {
+		ee = &EvalError{
+			Message:  err.Error(),
+			ArgIndex: -1,
+			Record:   -1,
+			Err:      err,
+		}
+	}
+	if ee.located {
+		return ee
+	}
+	ts := call.Value.([]Token)
+	ee.Func = fmt.Sprint(ts[0].Value)
+	ee.Position = call.Position
+	if ee.ArgIndex >= 0 && ee.ArgIndex < len(ts)-1 {
+		arg := unwrapScope(ts[ee.ArgIndex+1])
+		ee.Position = arg.Position
+		if arg.Type == Field {
+			ee.Path = arg.Value.(string)
+		}
+	}
+	ee.located = true
+	return ee
+}
+
+func (e *EvalError) Error() string {
+	msg := e.Message
+	if e.GoType != "" {
+		msg += fmt.Sprintf(" (got %s)", e.GoType)
+	}
+	where := make([]string, 0)
+	if e.Func != "" {
+		if e.ArgIndex >= 0 {
+			where = append(where, fmt.Sprintf("%s argument %d", e.Func, e.ArgIndex+1))
+		} else {
+			where = append(where, e.Func)
+		}
+	}
+	if e.Path != "" {
+		where = append(where, "field ["+e.Path+"]")
+	}
+	if e.Record >= 0 {
+		where = append(where, fmt.Sprintf("record %d", e.Record))
+	}
+	if len(where) > 0 {
+		msg += " in " + strings.Join(where, ", ")
+	}
+	return msg + fmt.Sprintf(" @ offset %d", e.Position)
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.Err
+}
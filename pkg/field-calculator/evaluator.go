@@ -1,80 +1,62 @@
 package fieldcalculator
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
-	"regexp"
-	"strconv"
-	"strings"
 )
 
+// ParserOption configures an Evaluator created by NewParser
+type ParserOption func(*Evaluator)
+
+// WithEnv resolves functions and operators through env instead of DefaultEnv
+func WithEnv(env *Env) ParserOption {
+	return func(ev *Evaluator) {
+		ev.env = env
+	}
+}
+
 // NewParser creates a new parser with nice defaults
-func NewParser() *Evaluator {
+func NewParser(opts ...ParserOption) *Evaluator {
 	ev := &Evaluator{
 		Tokens: make([]Token, 0),
 		fields: make([]Token, 0),
+		env:    DefaultEnv,
+	}
+	for _, opt := range opts {
+		opt(ev)
 	}
 	return ev
 }
 
-// resolvePath traverses struct object until it can't find the field requested or resolves
-//   forEval: will iterate slices so it can return a list of values otherwise this
-//            only tests the first to see if the path is resolvable
-func resolvePath(s interface{}, path []string, forEval bool) (_ []interface{}, bok bool) {
-	defer func() {
-		if recover() != nil {
-			bok = false
-		}
-	}()
-	if (s == nil && len(path) > 0) || len(path) == 0 {
-		return nil, false
-	}
-	o := reflect.ValueOf(s)
-	v := reflect.Indirect(o)
-	if v.Kind() == reflect.Slice {
-		if forEval {
-			var r []interface{} = make([]interface{}, 0)
-			for j := 0; j < v.Len(); j++ {
-				vifc := v.Index(j).Interface()
-				if res, bb := resolvePath(vifc, path, forEval); bb {
-					r = append(r, res...)
-				} else {
-					return nil, bb
-				}
-			}
-			return r, true
-		} else {
-			v = reflect.Indirect(v.Index(0))
-		}
-	}
-	lci := make(map[string]int)
-	for i := 0; i < v.NumField(); i++ {
-		lci[strings.ToLower(v.Type().Field(i).Name)] = i
+// resolvePath reports whether path can be resolved on the type of s. Index, slice and wildcard
+// selectors are checked against the lists they select from, maps and interfaces are only known
+// when evaluating so any path through them resolves.
+func (ev *Evaluator) resolvePath(s interface{}, path fieldPath) bool {
+	if len(path) == 0 {
+		return false
 	}
-	if _, ok := lci[path[0]]; ok {
-		if len(path) > 1 {
-			return resolvePath(v.Field(lci[strings.ToLower(path[0])]).Interface(), path[1:], forEval)
-		}
-		return []interface{}{v.Field(lci[strings.ToLower(path[0])]).Interface()}, true
-	}
-	return nil, false
+	ok, _ := ev.resolver.resolveType(reflect.TypeOf(s), path)
+	return ok
 }
 
 // AppliesTo returns true/false for whether the evaluation can be applied to struct
 //				   error is returned if something bad happened during evaluation
 func (ev *Evaluator) AppliesTo(s ...interface{}) (bool, error) {
-	checked := make(map[string]bool)
+	checked := make(map[reflect.Type]bool)
 	for _, o := range s {
 		t := reflect.TypeOf(o)
-		tt := fmt.Sprint(t)
-		if _, ok := checked[tt]; ok {
+		if checked[t] {
 			continue
 		}
+		checked[t] = true
 		for _, f := range ev.fields {
-			path := strings.Split(f.Value.(string), ".")
-			_, b := resolvePath(o, path, false)
-			if !b {
+			path, err := fieldPathOf(f)
+			if err != nil {
+				return false, err
+			}
+			if !ev.resolvePath(o, path.steps) {
 				return false, nil
 			}
 		}
@@ -85,12 +67,17 @@ func (ev *Evaluator) AppliesTo(s ...interface{}) (bool, error) {
 // Run will run evaluation per interface
 func (ev *Evaluator) Run(ss ...interface{}) ([]interface{}, error) {
 	var results []interface{} = make([]interface{}, 0)
-	for _, s := range ss {
+	for i, s := range ss {
 		res, err := ev.run(ev.Tokens, s)
 		if err != nil {
+			if ee, ok := err.(*EvalError); ok {
+				ee.Record = i
+			}
 			return nil, err
 		}
-		results = append(results, unwindResult(res)...)
+		for _, r := range unwindResult(res) {
+			results = append(results, ev.output(r))
+		}
 	}
 	return results, nil
 }
@@ -103,7 +90,7 @@ func (ev *Evaluator) RunMany(s ...interface{}) ([]interface{}, error) {
 		return nil, err
 	}
 	for _, r := range res {
-		results = append(results, unwindToken(r.(Token).Value))
+		results = append(results, ev.output(unwindToken(r.(Token).Value)))
 	}
 	return results, nil
 }
@@ -115,142 +102,121 @@ func (ev *Evaluator) Parse(s string) error {
 
 // AST returns a string of JSON AST
 func (ev *Evaluator) AST() string {
-	return strings.TrimSpace(ev.ast(ev.Tokens, 0))
+	bs, err := json.MarshalIndent(ev, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(bs)
+}
+
+// Tree returns the typed AST of the parsed formula, nil before anything was parsed
+func (ev *Evaluator) Tree() Node {
+	if len(ev.Tokens) != 1 {
+		return nil
+	}
+	n, err := nodeFromToken(ev.Tokens[0])
+	if err != nil {
+		return nil
+	}
+	return n
 }
 
-func (ev *Evaluator) ast(tokens []Token, depth int) string {
-	bd := strings.Repeat("  ", depth)
-	var ast string = ""
+// Load replaces the formula with a previously built AST, functions are checked against the env like Parse does
+func (ev *Evaluator) Load(n Node) error {
+	if n == nil {
+		return errors.New("No AST to load")
+	}
+	t, err := n.token()
+	if err != nil {
+		return err
+	}
+	if err := ev.known([]Token{t}, ""); err != nil {
+		return err
+	}
+	t = ev.coerceToken(t)
+	if err := ev.validate([]Token{t}, ""); err != nil {
+		return err
+	}
+	ev.Tokens = []Token{t}
+	ev.fields = collectFields(ev.Tokens)
+	return nil
+}
+
+// MarshalJSON stores the parsed formula as its JSON AST
+func (ev *Evaluator) MarshalJSON() ([]byte, error) {
+	if len(ev.Tokens) != 1 {
+		return nil, errors.New("Nothing parsed")
+	}
+	n, err := nodeFromToken(ev.Tokens[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(n)
+}
+
+// UnmarshalJSON loads a JSON AST without parsing the formula again
+func (ev *Evaluator) UnmarshalJSON(data []byte) error {
+	n, err := UnmarshalNode(data)
+	if err != nil {
+		return err
+	}
+	return ev.Load(n)
+}
+
+// environment is the env functions resolve through, DefaultEnv unless the Evaluator was given one
+func (ev *Evaluator) environment() *Env {
+	if ev.env == nil {
+		return DefaultEnv
+	}
+	return ev.env
+}
+
+// known makes sure every function and operator called exists in the env, src locates errors when known
+func (ev *Evaluator) known(tokens []Token, src string) error {
 	for _, x := range tokens {
 		switch x.Type {
 		case Scope:
-			ast += ev.ast(x.Value.([]Token), depth+1)
+			if err := ev.known(x.Value.([]Token), src); err != nil {
+				return err
+			}
 		case FuncScope:
-			ast += fmt.Sprintf("%s{\n%s  \"type\": \"func\",\n%s  \"name\": \"%s\",\n%s  \"args\": [\n", bd, bd, bd, x.Value.([]Token)[0].Value.(string), bd)
-			ast += ev.ast(x.Value.([]Token)[1:], depth+2)
-			ast += fmt.Sprintf("\n%s  ]\n%s},\n", bd, bd)
-		case Static:
-			ast += fmt.Sprintf("%s{ \"type\": \"literal\", \"value\": \"%s\" },\n", bd, x.Value)
-		case Field:
-			ast += fmt.Sprintf("%s{ \"type\": \"field\", \"name\": \"%s\" },\n", bd, x.Value.(string))
-		default:
-			fmt.Printf("error in generator, unhandled type:%v\n", x.Type)
+			ts := x.Value.([]Token)
+			name, ok := ts[0].Value.(string)
+			if !ok {
+				return parseErrorAt(src, x.Position, "", "Function name is missing")
+			}
+			if _, ok := ev.environment().Lookup(name); !ok {
+				return parseErrorAt(src, ts[0].Position, name, fmt.Sprintf("Unknown function or operator: '%s'", name))
+			}
+			if err := ev.known(ts[1:], src); err != nil {
+				return err
+			}
 		}
 	}
-	trimmer := regexp.MustCompile(`,[\r\n]*$`)
-	ast = trimmer.ReplaceAllString(ast, "")
-	return ast
+	return nil
 }
 
-func (ev *Evaluator) tokenize(s string) error {
-	idx := (int)(0)
-	ws := regexp.MustCompile(`^[, \t\r\n]+`)
-	stack := [][]Token{[]Token{}}
-	for idx < len(s) {
-		if m := ws.FindString(s[idx:]); len(m) > 0 {
-			idx += len(m)
-			continue
-		}
-		stacklen := len(stack) - 1
-		if t, m, err := parseField(idx, s); err == nil && m > 0 {
-			stack[stacklen] = append(stack[stacklen], t)
-			ev.fields = append(ev.fields, t)
-			idx += m
-		} else if err != nil {
-			return err
-		} else if t, m, err := parseOperator(idx, s); err == nil && m > 0 {
-			stack[stacklen] = append(stack[stacklen], t)
-			idx += m
-		} else if err != nil {
-			return err
-		} else if t, m := parseNumber(idx, s); m > 0 {
-			stack[stacklen] = append(stack[stacklen], t)
-			idx += m
-		} else if t, m, invalid := parseStr(idx, s); !invalid && m > 0 {
-			stack[stacklen] = append(stack[stacklen], t)
-			idx += m
-		} else if invalid {
-			return errorWithLineAndPos(idx, "Unterminated string")
-		} else if s[idx] == '(' {
-			stack = append(stack, []Token{})
-			idx++
-		} else if s[idx] == ')' {
-			// reduce function
-			if stacklen >= 1 && len(stack[stacklen-1]) > 0 && stack[stacklen-1][len(stack[stacklen-1])-1].Type == Function {
-				f := *(&Token{
-					Type:     FuncScope,
-					Value:    []Token{stack[stacklen-1][len(stack[stacklen-1])-1]},
-					Position: stack[stacklen-1][len(stack[stacklen-1])-1].Position,
-				})
-				f.Value = append(f.Value.([]Token), stack[stacklen]...)
-				stack[stacklen-1][len(stack[stacklen-1])-1] = f
-				stack = stack[:stacklen]
-			} else {
-				// arbitrary scope
-				v := stack[stacklen]
-				stack = stack[:stacklen]
-				stacklen = len(stack) - 1
-				stack[stacklen] = append(stack[stacklen], *(&Token{
-					Type:     Scope,
-					Value:    v,
-					Position: idx,
-				}))
+// validate checks every call against the signature registered in the env, src locates errors when known
+func (ev *Evaluator) validate(tokens []Token, src string) error {
+	for _, x := range tokens {
+		switch x.Type {
+		case Scope:
+			if err := ev.validate(x.Value.([]Token), src); err != nil {
+				return err
 			}
-			stacklen = len(stack) - 1
-			idx++
-		} else if t, m, invalid := parseFunction(idx, s); !invalid {
-			stack[stacklen] = append(stack[stacklen], t)
-			idx += m
-		} else if invalid {
-			return errorWithLineAndPos(idx, fmt.Sprintf("Unknown function or token: '%s'", s[idx:idx+m]))
-		}
-
-		// reducers
-		// a <operator> b, with precedence
-		reduce := stack[stacklen]
-		reducelen := len(reduce) - 1
-		if reducelen >= 2 && reduce[reducelen-1].Type == Operator {
-			a := reduce[reducelen-2]
-			o := reduce[reducelen-1]
-			b := reduce[reducelen]
-			h := false
-			if a.Type == Scope || a.Type == FuncScope {
-				op1, ok1 := a.Value.([]Token)[0].Value.(string)
-				if ok1 {
-					if prec, ok := operatorPrecedence[op1]; ok {
-						if prec2, ok := operatorPrecedence[o.Value.(string)]; ok {
-							if prec2 > prec {
-								a.Value = append(a.Value.([]Token)[:len(a.Value.([]Token))-1], *(&Token{
-									Type:     FuncScope,
-									Value:    []Token{o, a.Value.([]Token)[len(a.Value.([]Token))-1], b},
-									Position: o.Position,
-								}))
-								reduce[reducelen-2] = a
-								reduce = reduce[:reducelen-1]
-								h = true
-							}
-						}
-					}
+		case FuncScope:
+			ts := x.Value.([]Token)
+			v, _ := ev.environment().Lookup(ts[0].Value.(string))
+			if fn, ok := v.(*FunctionDef); ok {
+				if err := fn.checkArgs(ts[0], ts[1:]); err != nil {
+					return err.withSource(src)
 				}
 			}
-			if !h {
-				reduce = append(reduce[0:reducelen-2], *(&Token{
-					Type:     FuncScope,
-					Value:    []Token{o, a, b},
-					Position: o.Position,
-				}))
+			if err := ev.validate(ts[1:], src); err != nil {
+				return err
 			}
-			stack[stacklen] = reduce
 		}
 	}
-	if len(stack) != 1 {
-		return errorWithLineAndPos(idx, "Unknown error")
-	}
-	if len(stack[0]) != 1 {
-		fmt.Printf("stack=%v\n", stack)
-		return errorWithLineAndPos(stack[0][0].Position, "Unhandled reduce situation")
-	}
-	ev.Tokens = stack[0]
 	return nil
 }
 
@@ -265,144 +231,127 @@ func (ev *Evaluator) run(tokens []Token, s ...interface{}) ([]interface{}, error
 			}
 			rval = append(rval, res...)
 		case FuncScope:
-			args, err := ev.run(x.Value.([]Token)[1:], s...)
-			if err != nil {
-				return nil, err
-			}
-			argTokens := make([]Token, 0)
-			for _, t := range args {
-				argTokens = append(argTokens, t.(Token))
-			}
-			result, err := DefaultEnv.Values[strings.ToUpper(x.Value.([]Token)[0].Value.(string))].(func(_ []Token) (Token, error))(argTokens)
-			if err != nil {
-				return nil, err
+			name := x.Value.([]Token)[0].Value.(string)
+			var result Token
+			v, _ := ev.environment().Lookup(name)
+			switch fn := v.(type) {
+			case *FunctionDef:
+				if fn.Lazy != nil {
+					r, err := fn.Lazy(ev.thunks(x.Value.([]Token)[1:], s...))
+					if err != nil {
+						return nil, locate(err, x)
+					}
+					result = r
+					break
+				}
+				argTokens := make([]Token, 0)
+				for _, a := range x.Value.([]Token)[1:] {
+					res, err := ev.run([]Token{a}, s...)
+					if err != nil {
+						return nil, err
+					}
+					argTokens = append(argTokens, argumentToken(res, a.Position))
+				}
+				r, err := fn.Fn(argTokens)
+				if err != nil {
+					return nil, locate(err, x)
+				}
+				result = r
+			case func(_ []Token) (Token, error):
+				// untyped functions receive every value flattened into one list
+				args, err := ev.run(x.Value.([]Token)[1:], s...)
+				if err != nil {
+					return nil, err
+				}
+				argTokens := make([]Token, 0)
+				for _, t := range args {
+					argTokens = append(argTokens, t.(Token))
+				}
+				r, err := fn(argTokens)
+				if err != nil {
+					// flattened arguments cannot be traced back to what was written
+					if ee, ok := err.(*EvalError); ok {
+						ee.ArgIndex = -1
+					}
+					return nil, locate(err, x)
+				}
+				result = r
+			default:
+				return nil, locate(errors.New(fmt.Sprintf("Unknown function or operator: '%s'", name)), x)
 			}
-			rval = append(rval, result)
+			rval = append(rval, ev.coerceToken(result))
 		case Static:
 			rval = append(rval, x)
 		case Field:
+			path, err := fieldPathOf(x)
 			for _, t := range s {
-				vs, b := resolvePath(t, strings.Split(strings.ToLower(x.Value.(string)), "."), true)
-				if !b {
-					return nil, errors.New("Field is unresolveable")
+				var vs []interface{}
+				if err == nil {
+					vs, err = ev.resolver.resolveValue(reflect.ValueOf(t), path.steps, path.plan(ev.resolver, reflect.TypeOf(t)))
+				}
+				if err != nil {
+					return nil, &EvalError{
+						Message:  err.Error(),
+						ArgIndex: -1,
+						GoType:   fmt.Sprintf("%T", t),
+						Path:     x.Value.(string),
+						Position: x.Position,
+						Record:   -1,
+						Err:      err,
+						located:  true,
+					}
 				}
 				for _, v := range vs {
 					rval = append(rval, *(&Token{
-						Value:    v,
+						Value:    ev.coerceValue(v),
 						Type:     Static,
 						Position: x.Position,
 					}))
 				}
 			}
 		default:
-			return nil, errors.New(fmt.Sprintf("unhandled type in runner:%v\n", x.Type))
+			return nil, &EvalError{
+				Message:  fmt.Sprintf("unhandled type in runner:%v", x.Type),
+				ArgIndex: -1,
+				Position: x.Position,
+				Record:   -1,
+				located:  true,
+			}
 		}
 	}
 	return rval, nil
 }
 
-func parseStr(idx int, s string) (Token, int, bool) {
-	if s[idx] != '"' && s[idx] != '\'' {
-		return *(&Token{}), 0, false
-	}
-	oidx := idx + 1
-	for oidx < len(s) {
-		if s[oidx] == s[idx] && s[oidx-1] != '\\' {
-			break
-		}
-		oidx++
-	}
-	if oidx >= len(s) {
-		return *(&Token{}), idx, true
+// thunks defers evaluation of each argument until a lazy function asks for it
+func (ev *Evaluator) thunks(args []Token, s ...interface{}) []Thunk {
+	ths := make([]Thunk, 0, len(args))
+	for _, a := range args {
+		a := a
+		ths = append(ths, func() (Token, error) {
+			res, err := ev.run([]Token{a}, s...)
+			if err != nil {
+				return *(&Token{}), err
+			}
+			return argumentToken(res, a.Position), nil
+		})
 	}
-	return *(&Token{
-		Type:     Static,
-		Value:    s[idx+1 : oidx],
-		Position: idx,
-	}), oidx - idx + 1, false
+	return ths
 }
 
-func parseNumber(idx int, s string) (Token, int) {
-	if s[idx] < '0' || s[idx] > '9' {
-		return *(&Token{}), 0
+// argumentToken turns the values one argument evaluated to into a single token, several values become a list
+func argumentToken(res []interface{}, pos int) Token {
+	if len(res) == 1 {
+		return res[0].(Token)
 	}
-	oidx := idx
-	foundDot := false
-	for oidx < len(s) {
-		if (s[oidx] < '0' || s[oidx] > '9') && (!foundDot && s[oidx] != '.') {
-			break
-		}
-		if s[oidx] == '.' {
-			foundDot = true
-		}
-		oidx++
-	}
-	v, e := strconv.ParseFloat(s[idx:oidx], 64)
-	if e != nil {
-		return *(&Token{}), 0
+	ts := make([]Token, 0, len(res))
+	for _, r := range res {
+		ts = append(ts, r.(Token))
 	}
 	return *(&Token{
-		Type:     Static,
-		Value:    v,
-		Position: idx,
-	}), oidx - idx
-}
-
-func parseField(idx int, s string) (Token, int, error) {
-	if s[idx] != '[' {
-		return *(&Token{}), 0, nil
-	}
-	oidx := idx + 1
-	for oidx < len(s) {
-		if s[oidx] == ']' {
-			return *(&Token{
-				Type:     Field,
-				Value:    (string)(s[idx+1 : oidx]),
-				Position: idx,
-			}), oidx - idx + 1, nil
-		}
-		oidx++
-	}
-	return *(&Token{}), idx, errorWithLineAndPos(idx, "Unterminated field")
-}
-
-func parseFunction(idx int, s string) (Token, int, bool) {
-	oidx := idx
-	validFuncName := regexp.MustCompile(`^[a-zA-Z][a-zA-Z_0-9-]+`)
-	if m := validFuncName.FindString(s[idx:]); len(m) > 0 {
-		if _, ok := DefaultEnv.Values[strings.ToUpper(m)]; ok {
-			return *(&Token{
-				Type:     Function,
-				Value:    m,
-				Position: idx,
-			}), oidx - idx + len(m), false
-		}
-		return *(&Token{}), oidx - idx + len(m), true
-	}
-	return *(&Token{}), oidx - idx + 1, true
-}
-
-func parseOperator(idx int, s string) (Token, int, error) {
-	st := (string)(s[idx])
-	if st == "+" || st == "-" || st == "*" || st == "/" || st == "=" || st == ">" {
-		return *(&Token{
-			Type:     Operator,
-			Value:    st,
-			Position: idx,
-		}), 1, nil
-	}
-	return *(&Token{}), 0, nil
-}
-
-func errorWithLineAndPos(idx int, s string) error {
-	lines := strings.Split(s, "\n")
-	count := (int)(0)
-	line := (int)(0)
-	for count+len(lines[line]) < idx {
-		count += len(lines[line])
-		line++
-	}
-	return errors.New(s + fmt.Sprintf(" @ line %d, character %d", line, idx-count))
+		Type:     Scope,
+		Value:    ts,
+		Position: pos,
+	})
 }
 
 func unwindResult(xs []interface{}) []interface{} {
@@ -410,7 +359,6 @@ func unwindResult(xs []interface{}) []interface{} {
 	for _, x := range xs {
 		r = append(r, unwindToken(x)...)
 	}
-	fmt.Printf("r=%v\n", r)
 	return r
 }
 
@@ -421,8 +369,7 @@ func unwindToken(t interface{}) []interface{} {
 	case []Token:
 		var rs []interface{} = make([]interface{}, 0)
 		for _, tx := range t.([]Token) {
-			rs = append(rs, unwindToken(tx))
-
+			rs = append(rs, unwindToken(tx)...)
 		}
 		return rs
 	}
@@ -1,7 +1,12 @@
 package fieldcalculator_test
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
+	"math/big"
+	"strings"
 	"testing"
 
 	fieldCalculator "example.com/lr/pkg/field-calculator"
@@ -53,13 +58,13 @@ func TestEvaluator_Slices(t *testing.T) {
 	if ok, err := rcptField.AppliesTo(&Product{}); err != nil {
 		t.Logf("err=%v\n", err)
 		t.Fail()
-	} else if !ok {
+	} else if ok {
 		t.Logf("this field should not apply to &Product{}")
 		t.Fail()
 	}
 
 	t.Run("sum([lines.price])*0.2", func(t *testing.T) {
-		if rcptField.AST() != "{\n  \"type\": \"func\",\n  \"name\": \"*\",\n  \"args\": [\n    {\n      \"type\": \"func\",\n      \"name\": \"sum\",\n      \"args\": [\n        { \"type\": \"field\", \"name\": \"lines.price\" }\n      ]\n    },\n    { \"type\": \"literal\", \"value\": \"%!s(float64=0.2)\" }\n  ]\n}" {
+		if rcptField.AST() != "{\n  \"type\": \"func\",\n  \"name\": \"*\",\n  \"operator\": true,\n  \"args\": [\n    {\n      \"type\": \"func\",\n      \"name\": \"sum\",\n      \"args\": [\n        {\n          \"type\": \"field\",\n          \"name\": \"lines.price\",\n          \"position\": 4\n        }\n      ],\n      \"position\": 0\n    },\n    {\n      \"type\": \"literal\",\n      \"kind\": \"number\",\n      \"value\": 0.2,\n      \"position\": 21\n    }\n  ],\n  \"position\": 19\n}" {
 			t.Logf("AST is not as expected")
 			t.Fail()
 		}
@@ -83,6 +88,32 @@ func TestEvaluator_Slices(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("list results are flat", func(t *testing.T) {
+		for _, k := range []string{"[lines.price]", "[lines.price] * 2", "[lines.price] / 2", "[lines.price] + 1"} {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling %s:%v", k, err)
+				t.FailNow()
+			}
+			r, err := l.Run(rcpt)
+			if err != nil {
+				t.Logf("error in calc %s:%v", k, err)
+				t.FailNow()
+			}
+			if len(r) != 3 {
+				t.Logf("%s: expected 3 results,got=%v", k, r)
+				t.Fail()
+				continue
+			}
+			for _, v := range r {
+				if _, ok := v.(float64); !ok {
+					t.Logf("%s: expected=float64,got=%T", k, v)
+					t.Fail()
+				}
+			}
+		}
+	})
 }
 
 func TestEvaluator_Calculators(t *testing.T) {
@@ -97,7 +128,7 @@ func TestEvaluator_Calculators(t *testing.T) {
 		"sum([price])":                           65.25,
 		"(((((((((([price]))))))))))":            65.25,
 		"    5 +     6.1235566777":               5 + 6.1235566777,
-		"\"escaped \\\" q\"":                     "escaped \\\" q",
+		"\"escaped \\\" q\"":                     "escaped \" q",
 		"\"hello: \" + concat(\"world\", \"!\")": "hello: world!",
 		"sumif([price], [name] = 'Prod 1')":      0.00,
 		"sumif([price], [price] > 2)":            65.25,
@@ -106,6 +137,36 @@ func TestEvaluator_Calculators(t *testing.T) {
 		"1 + 2 / 3 = 1":                          false,
 		" 1 + 2 = 5 + 'hello'":                   false,
 		"1 + 1 + 1 + 1 / 4 / 1":                  3.25,
+		"[price] < 100":                          true,
+		"[price] <= 65.25":                       true,
+		"[price] >= 66":                          false,
+		"[price] <> 65.25":                       false,
+		"[name] != 'product 2'":                  true,
+		"sumif([price], [price] < 10)":           0.00,
+		"[price] - 5":                            60.25,
+		"10 - 2 - 3":                             int64(5),
+		"10 - 2 * 3":                             int64(4),
+		"-5 + 2":                                 int64(-3),
+		"1 - -1":                                 int64(2),
+		"-[price]":                               -65.25,
+		"2 * -[price]":                           -130.5,
+		"-(1 + 2) * 2":                           int64(-6),
+		"-sum([price]) + 1":                      -64.25,
+		"sum(1, -2)":                             int64(-1),
+		"and([price] > 1, [name] = 'product 1')": true,
+		"or([price] < 1, [name] = 'x')":          false,
+		"not([price] < 1)":                       true,
+		"[price] > 1 && [price] < 100":           true,
+		"[price] > 100 || [name] = 'product 1'":  true,
+		"if([price] > 100, 'big', 'small')":      "small",
+		"if([price] > 1, [price] / 1, 1 / 0)":    65.25,
+		"ifs([price] > 100, 1, [price] > 50, 2)": int64(2),
+		"1 * 2 + 3 * 4 - 5 / 6":                  2 + 12 - 5.0/6.0,
+		"2 - 3 * 4 + 10 / 5 * 2":                 int64(-6),
+		"100 / 10 / 5":                           int64(2),
+		"1 + 2 * 3 = 7":                          true,
+		"1 = 2 + 3 * 4 - 13":                     true,
+		"sumif([price], [price] > 2.5)":          65.25,
 	}
 	//		"sum([price], [amount])":                 "",
 	//		"([price] + [amount]) * 1":               "",
@@ -154,3 +215,1898 @@ func TestEvaluator_Calculators(t *testing.T) {
 		})
 	}
 }
+
+func TestEvaluator_Env(t *testing.T) {
+	prod := &Product{Name: "product 1", Price: 2.5}
+	tenant := fieldCalculator.NewEnv(fieldCalculator.DefaultEnv)
+	tenant.Set("double", func(ts []fieldCalculator.Token) (fieldCalculator.Token, error) {
+		return fieldCalculator.Token{
+			Type:  fieldCalculator.Static,
+			Value: ts[0].Value.(float64) * 2,
+		}, nil
+	})
+
+	if err := fieldCalculator.NewParser().Parse("double([price])"); err == nil {
+		t.Logf("DefaultEnv should not see functions registered on a child env")
+		t.Fail()
+	}
+	if _, ok := fieldCalculator.DefaultEnv.Lookup("DOUBLE"); ok {
+		t.Logf("registering on a child env leaked into DefaultEnv")
+		t.Fail()
+	}
+
+	l := fieldCalculator.NewParser(fieldCalculator.WithEnv(tenant))
+	if err := l.Parse("double([price]) * 3"); err != nil {
+		t.Logf("error compiling:%v", err)
+		t.FailNow()
+	}
+	r, err := l.Run(prod)
+	if err != nil {
+		t.Logf("error in calc:%v", err)
+		t.FailNow()
+	}
+	if len(r) != 1 || r[0] != 15.0 {
+		t.Logf("expected=15,got=%v", r)
+		t.Fail()
+	}
+
+	zero := &fieldCalculator.Evaluator{}
+	if err := zero.Parse("sum(1)"); err != nil {
+		t.Logf("a zero-value Evaluator should fall back to DefaultEnv, err=%v", err)
+		t.Fail()
+	}
+	if err := zero.Parse("1 + 1"); err != nil {
+		t.Logf("error compiling:%v", err)
+		t.FailNow()
+	}
+	if r, err := zero.Run(prod); err != nil || len(r) != 1 || r[0] != int64(2) {
+		t.Logf("expected=2,got=%v,err=%v", r, err)
+		t.Fail()
+	}
+
+	bare := fieldCalculator.NewParser(fieldCalculator.WithEnv(fieldCalculator.NewEnv(nil)))
+	var perr *fieldCalculator.ParseError
+	if err := bare.Parse("1 + 1"); !errors.As(err, &perr) || perr.Offset != 2 {
+		t.Logf("operators missing from the env should fail at Parse, err=%v", err)
+		t.Fail()
+	}
+}
+
+func TestEvaluator_RegisterFunction(t *testing.T) {
+	env := fieldCalculator.NewEnv(fieldCalculator.DefaultEnv)
+	err := env.RegisterFunction("repeat", 2, 2, []fieldCalculator.ArgKind{fieldCalculator.StringArg, fieldCalculator.NumberArg}, func(ts []fieldCalculator.Token) (fieldCalculator.Token, error) {
+		s := ""
+		n, _ := fieldCalculator.ToInt64(ts[1].Value)
+		for i := int64(0); i < n; i++ {
+			s += ts[0].Value.(string)
+		}
+		return fieldCalculator.Token{Type: fieldCalculator.Static, Value: s}, nil
+	})
+	if err != nil {
+		t.Logf("error registering:%v", err)
+		t.FailNow()
+	}
+	if err := env.RegisterFunction("broken", 3, 1, nil, func(ts []fieldCalculator.Token) (fieldCalculator.Token, error) {
+		return ts[0], nil
+	}); err == nil {
+		t.Logf("max arity below min arity should not register")
+		t.Fail()
+	}
+
+	l := fieldCalculator.NewParser(fieldCalculator.WithEnv(env))
+	if err := l.Parse("repeat([name], 2)"); err != nil {
+		t.Logf("error compiling:%v", err)
+		t.FailNow()
+	}
+	r, err := l.Run(&Product{Name: "ab"})
+	if err != nil {
+		t.Logf("error in calc:%v", err)
+		t.FailNow()
+	}
+	if len(r) != 1 || r[0] != "abab" {
+		t.Logf("expected=abab,got=%v", r)
+		t.Fail()
+	}
+
+	for _, bad := range []string{
+		"SUM()",
+		"SUMIF([a])",
+		"SUM('abc')",
+		"repeat('x')",
+		"repeat('x', 1, 2)",
+		"repeat(1, 2)",
+	} {
+		t.Run(bad, func(t *testing.T) {
+			if err := fieldCalculator.NewParser(fieldCalculator.WithEnv(env)).Parse(bad); err == nil {
+				t.Logf("expected a parse error")
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestEvaluator_Comparisons(t *testing.T) {
+	rcpt := &Receipt{
+		Lines: (&[]Product{
+			*&Product{Name: "Prod 1", Price: 1.11},
+			*&Product{Name: "Prod 2", Price: 2.22},
+			*&Product{Name: "Prod 3", Price: 3.33},
+		}),
+	}
+	OK := map[string]float64{
+		"sumif([lines.price], [lines.price] < 2)":           1.11,
+		"sumif([lines.price], [lines.price] <= 3)":          1.11 + 2.22,
+		"sumif([lines.price], [lines.price] >= 2)":          2.22 + 3.33,
+		"sumif([lines.price], [lines.name] <> 'Prod 2')":    1.11 + 3.33,
+		"sumif([lines.price], [lines.name] != 'Prod 1')":    2.22 + 3.33,
+		"sumif([lines.price], [lines.price] > 1 + 2)":       3.33,
+		"sumif([lines.price], [lines.name] = 'Prod 3') * 2": 3.33 * 2,
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			r, err := l.Run(rcpt)
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 || math.Abs(r[0].(float64)-expect) > .0000000001 {
+				t.Logf("expected=%v,got=%v", expect, r)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestEvaluator_FloatComparisons(t *testing.T) {
+	OK := map[string]bool{
+		"1.000001 > 1":                 true,
+		"1 < 1.000001":                 true,
+		"0.000001 > 0":                 true,
+		"0 < 0.000001":                 true,
+		"0.000001 = 0":                 false,
+		"0.0000000001 <> 0.0000000002": true,
+		"1e-20 < 2e-20":                true,
+		"1e20 < 1.00001e20":            true,
+		"0.1 + 0.2 = 0.3":              true,
+		"0.1 + 0.2 <> 0.3":             false,
+		"0.1 + 0.2 > 0.3":              true,
+		"1e20 + 1 = 1e20":              true,
+		"1.000001 = 1":                 false,
+		"1.000001 >= 1":                true,
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			r, err := l.Run(&Product{})
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 || r[0] != expect {
+				t.Logf("expected=%v,got=%v", expect, r)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestEvaluator_Logic(t *testing.T) {
+	rcpt := &Receipt{
+		Lines: (&[]Product{
+			*&Product{Name: "Prod 1", Price: 1.11},
+			*&Product{Name: "Prod 2", Price: 2.22},
+			*&Product{Name: "Prod 3", Price: 3.33},
+		}),
+	}
+	OK := map[string]float64{
+		"sumif([lines.price], [lines.price] > 2 && [lines.name] != 'Prod 3')": 2.22,
+		"sumif([lines.price], [lines.price] < 2 || [lines.price] > 3)":        1.11 + 3.33,
+		"sumif([lines.price], not([lines.name] = 'Prod 1'))":                  2.22 + 3.33,
+		"sum(if([lines.price] > 2, [lines.price], 0))":                        2.22 + 3.33,
+		"sum(if([lines.price] > 0, [lines.price], 1 / 0))":                    1.11 + 2.22 + 3.33,
+		"sum(if([lines.price] < 0, [unknown], [lines.price]))":                1.11 + 2.22 + 3.33,
+		"if(sum([lines.price]) < 1, [unknown], 2)":                            2,
+		"if(sum([lines.price]) > 1 || [unknown], 2, 3)":                       2,
+		"if(sum([lines.price]) < 1 && [unknown], 2, 3)":                       3,
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			r, err := l.Run(rcpt)
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 {
+				t.Logf("expected=%v,got=%v", expect, r)
+				t.FailNow()
+			}
+			if f, ok := fieldCalculator.ToFloat64(r[0]); !ok || math.Abs(f-expect) > .0000000001 {
+				t.Logf("expected=%v,got=%v", expect, r)
+				t.Fail()
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		"1 / 0",
+		"ifs([lines.price] > 100, 1)",
+	} {
+		t.Run(bad, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(bad); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			if _, err := l.Run(rcpt); err == nil {
+				t.Logf("expected an error from running")
+				t.Fail()
+			}
+		})
+	}
+}
+
+type Order struct {
+	Qty    int
+	Count  uint32
+	Big    int64
+	Weight float32
+	Amount json.Number
+	Rate   *big.Rat
+	Lines  []Line
+}
+
+type Line struct {
+	Qty int16
+}
+
+func TestEvaluator_Numbers(t *testing.T) {
+	order := &Order{
+		Qty:    3,
+		Count:  4,
+		Big:    math.MaxInt64,
+		Weight: 0.1,
+		Amount: json.Number("12.5"),
+		Rate:   big.NewRat(1, 4),
+		Lines:  []Line{{Qty: 1}, {Qty: 2}, {Qty: 3}},
+	}
+	OK := map[string]interface{}{
+		"[qty]":              int64(3),
+		"[qty] * [count]":    int64(12),
+		"[qty] + 0.5":        3.5,
+		"[qty] / 3":          int64(1),
+		"[qty] / 2":          1.5,
+		"[weight]":           0.1,
+		"[weight] * 10":      1.0,
+		"[amount] * 2":       25.0,
+		"[rate] * 4":         1.0,
+		"sum([lines.qty])":   int64(6),
+		"[big] + 1":          float64(math.MaxInt64) + 1,
+		"[big] - 1":          int64(math.MaxInt64 - 1),
+		"[qty] = 3.0":        true,
+		"[count] > [qty]":    true,
+		"concat([qty], 'x')": "3x",
+		"7":                  int64(7),
+		"7.0":                7.0,
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			r, err := l.Run(order)
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 || r[0] != expect {
+				t.Logf("expected=%v (%T),got=%v (%T)", expect, expect, r[0], r[0])
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestEvaluator_Decimals(t *testing.T) {
+	rcpt := &Receipt{
+		Lines: (&[]Product{
+			*&Product{Name: "Prod 1", Price: 1.11},
+			*&Product{Name: "Prod 2", Price: 2.22},
+			*&Product{Name: "Prod 3", Price: 3.33},
+		}),
+	}
+	type expectation struct {
+		opts   []fieldCalculator.ParserOption
+		expect string
+	}
+	exact := fieldCalculator.WithExactDecimals()
+	OK := map[string]expectation{
+		"sum([lines.price])":                          {[]fieldCalculator.ParserOption{exact}, "333/50"},
+		"sum([lines.price]) = 6.66":                   {[]fieldCalculator.ParserOption{exact}, "true"},
+		"0.1 + 0.2 = 0.3":                             {[]fieldCalculator.ParserOption{exact}, "true"},
+		"sumif([lines.price], [lines.price] > 2) * 3": {[]fieldCalculator.ParserOption{exact}, "333/20"},
+		"1 / 3":                                  {[]fieldCalculator.ParserOption{exact, fieldCalculator.WithRounding(2, fieldCalculator.RoundHalfUp)}, "33/100"},
+		"-2.5":                                   {[]fieldCalculator.ParserOption{exact, fieldCalculator.WithRounding(0, fieldCalculator.RoundHalfUp)}, "-3"},
+		"2.5":                                    {[]fieldCalculator.ParserOption{exact, fieldCalculator.WithRounding(0, fieldCalculator.RoundHalfEven)}, "2"},
+		"2.01":                                   {[]fieldCalculator.ParserOption{exact, fieldCalculator.WithRounding(1, fieldCalculator.RoundCeiling)}, "21/10"},
+		"-2.01":                                  {[]fieldCalculator.ParserOption{exact, fieldCalculator.WithRounding(1, fieldCalculator.RoundDown)}, "-2"},
+		"1234":                                   {[]fieldCalculator.ParserOption{exact, fieldCalculator.WithRounding(-2, fieldCalculator.RoundFloor)}, "1200"},
+		"0.30000000000000000000000000001 - 0.3":  {[]fieldCalculator.ParserOption{exact}, "1/100000000000000000000000000000"},
+		"-0.30000000000000000000000000001 + 0.3": {[]fieldCalculator.ParserOption{exact}, "-1/100000000000000000000000000000"},
+		"-0.1":                                   {[]fieldCalculator.ParserOption{exact}, "-1/10"},
+		"-0.1 * 3 = -0.3":                        {[]fieldCalculator.ParserOption{exact}, "true"},
+		"-9223372036854775808":                   {[]fieldCalculator.ParserOption{exact}, "-9223372036854775808"},
+		"-9223372036854775809 + 1":               {[]fieldCalculator.ParserOption{exact}, "-9223372036854775808"},
+		"sum([lines.price]) + ' USD'":            {[]fieldCalculator.ParserOption{exact}, "6.66 USD"},
+		"sum([lines.price]) * 1.5":               {[]fieldCalculator.ParserOption{fieldCalculator.WithRounding(2, fieldCalculator.RoundHalfUp)}, "9.99"},
+		"if(sum([lines.price]) > 6.659999, 'more', 'less')": {[]fieldCalculator.ParserOption{exact}, "more"},
+	}
+	for k, c := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser(c.opts...)
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			r, err := l.Run(rcpt)
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			got := fmt.Sprint(r[0])
+			if rat, ok := r[0].(*big.Rat); ok {
+				got = rat.RatString()
+			}
+			if got != c.expect {
+				t.Logf("expected=%s,got=%s", c.expect, got)
+				t.Fail()
+			}
+		})
+	}
+
+	l := fieldCalculator.NewParser(exact)
+	if err := l.Parse("[price] * 1.10"); err != nil {
+		t.Logf("error compiling:%v", err)
+		t.FailNow()
+	}
+	if l.Format() != "[price] * 1.1" {
+		t.Logf("expected=[price] * 1.1,got=%s", l.Format())
+		t.Fail()
+	}
+	bs, err := json.Marshal(l)
+	if err != nil {
+		t.Logf("error marshaling:%v", err)
+		t.FailNow()
+	}
+	if !strings.Contains(string(bs), `"kind":"decimal","value":"1.1"`) {
+		t.Logf("decimal literal should be stored as a string, got=%s", bs)
+		t.Fail()
+	}
+	loaded := fieldCalculator.NewParser()
+	if err := json.Unmarshal(bs, loaded); err != nil {
+		t.Logf("error loading:%v", err)
+		t.FailNow()
+	}
+	if r, err := loaded.Run(&Product{Price: 2}); err != nil || len(r) != 1 || r[0] != 2.2 {
+		t.Logf("a loaded decimal should run as a float outside exact mode, got=%v (%v)", r, err)
+		t.Fail()
+	}
+	negative := "-0.30000000000000000000000000001 + 0.3"
+	parsed := fieldCalculator.NewParser(exact)
+	if err := parsed.Parse(negative); err != nil {
+		t.Logf("error compiling:%v", err)
+		t.FailNow()
+	}
+	if parsed.Format() != negative {
+		t.Logf("expected=%s,got=%s", negative, parsed.Format())
+		t.Fail()
+	}
+	if bs, err = json.Marshal(parsed); err != nil {
+		t.Logf("error marshaling:%v", err)
+		t.FailNow()
+	}
+	loaded = fieldCalculator.NewParser(exact)
+	if err := json.Unmarshal(bs, loaded); err != nil {
+		t.Logf("error loading:%v", err)
+		t.FailNow()
+	}
+	a, errA := parsed.Run(&Product{})
+	b, errB := loaded.Run(&Product{})
+	if errA != nil || errB != nil || fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Logf("parsed and loaded formulas should agree, parsed=%v (%v), loaded=%v (%v)", a, errA, b, errB)
+		t.Fail()
+	}
+}
+
+func TestEvaluator_Math(t *testing.T) {
+	rcpt := &Receipt{
+		Lines: (&[]Product{
+			*&Product{Name: "Prod 1", Price: 1.15},
+			*&Product{Name: "Prod 2", Price: -2.25},
+			*&Product{Name: "Prod 3", Price: 3.5},
+		}),
+	}
+	OK := map[string]string{
+		"round(2.675, 2)":                        "2.68",
+		"round(-2.5)":                            "-3",
+		"round(1234, -2)":                        "1200",
+		"round([lines.price], 1)":                "[1.2 -2.3 3.5]",
+		"roundup(1.21, 1)":                       "1.3",
+		"roundup(-1.21, 1)":                      "-1.3",
+		"rounddown(-1.29, 1)":                    "-1.2",
+		"trunc(9.99)":                            "9",
+		"floor(7, 2)":                            "6",
+		"floor(-2.5)":                            "-3",
+		"floor(2.37, 0.05)":                      "2.35",
+		"ceiling(7, 2)":                          "8",
+		"ceiling([lines.price])":                 "[2 -2 4]",
+		"ceiling(3, 0)":                          "0",
+		"abs([lines.price])":                     "[1.15 2.25 3.5]",
+		"abs(-4)":                                "4",
+		"sign([lines.price])":                    "[1 -1 1]",
+		"sign(0)":                                "0",
+		"mod(10, 3)":                             "1",
+		"mod(-3, 2)":                             "1",
+		"mod(3, -2)":                             "-1",
+		"mod(5.5, 2)":                            "1.5",
+		"power(2, 10)":                           "1024",
+		"power(2, -1)":                           "0.5",
+		"power(4, 0.5)":                          "2",
+		"2 ^ 3 ^ 2":                              "512",
+		"(2 ^ 3) ^ 2":                            "64",
+		"2 * 3 ^ 2":                              "18",
+		"-2 ^ 2":                                 "4",
+		"[lines.price] ^ 2":                      "[1.3224999999999998 5.0625 12.25]",
+		"sqrt(16)":                               "4",
+		"exp(0)":                                 "1",
+		"ln(exp(2))":                             "2",
+		"log10(1000)":                            "3",
+		"round(log10(1000), 10)":                 "3",
+		"sum(abs([lines.price])) ^ 1":            "6.9",
+		"round(sqrt(sum([lines.price] ^ 2)), 3)": "4.317",
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			r, err := l.Run(rcpt)
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			got := fmt.Sprint(r)
+			if len(r) == 1 {
+				got = fmt.Sprint(r[0])
+			}
+			if got != expect {
+				t.Logf("expected=%s,got=%s", expect, got)
+				t.Fail()
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		"sqrt(-1)",
+		"ln(0)",
+		"log10([lines.price])",
+		"mod(1, 0)",
+		"power(0, -1)",
+		"(-8) ^ (1 / 3)",
+		"power(10, 400.5)",
+		"2 ^ 1024",
+		"power(-2, 1025)",
+		"0.5 ^ -1024",
+		"exp(1000)",
+		"round(1.5, 0.5)",
+		"floor(2, -1)",
+		"abs([lines.name])",
+	} {
+		t.Run(bad, func(t *testing.T) {
+			for _, opts := range [][]fieldCalculator.ParserOption{nil, {fieldCalculator.WithExactDecimals()}} {
+				l := fieldCalculator.NewParser(opts...)
+				if err := l.Parse(bad); err != nil {
+					t.Logf("error compiling:%v", err)
+					t.FailNow()
+				}
+				_, err := l.Run(rcpt)
+				var ee *fieldCalculator.EvalError
+				if !errors.As(err, &ee) {
+					t.Logf("expected an EvalError, got=%v", err)
+					t.Fail()
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluator_Aggregates(t *testing.T) {
+	rcpt := &Receipt{
+		Lines: (&[]Product{
+			*&Product{Name: "Prod 1", Price: 2.22},
+			*&Product{Name: "Prod 2", Price: 1.11},
+			*&Product{Name: "", Price: 3.33},
+			*&Product{Name: "Prod 4", Price: 2.22},
+		}),
+	}
+	OK := map[string]string{
+		"average([lines.price])":                              "2.22",
+		"average(1, 2, 3, 4)":                                 "2.5",
+		"average(2, 4)":                                       "3",
+		"min([lines.price])":                                  "1.11",
+		"max([lines.price], 10)":                              "10",
+		"min(sumif([lines.price], [lines.price] > 100))":      "0",
+		"count([lines.price])":                                "4",
+		"count([lines.name], 1, 'x')":                         "1",
+		"counta([lines.name])":                                "4",
+		"countblank([lines.name])":                            "1",
+		"product([lines.price] * 0 + 2)":                      "16",
+		"product(1.5, 2)":                                     "3",
+		"median([lines.price])":                               "2.22",
+		"median(1, 2, 3, 4)":                                  "2.5",
+		"median(5, 1, 3)":                                     "3",
+		"mode([lines.price])":                                 "2.22",
+		"mode(1, 2, 2, 1)":                                    "1",
+		"mode(3, 1, 3.0, 1, 1)":                               "1",
+		"mode(5, 2, 2.0)":                                     "2",
+		"var(1, 2, 3, 4)":                                     "1.6666666666666667",
+		"var(2, 4, 6)":                                        "4",
+		"stdev(2, 4, 6)":                                      "2",
+		"round(stdev([lines.price]), 4)":                      "0.9063",
+		"if(count([lines.price]) > 3, max([lines.price]), 0)": "3.33",
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			r, err := l.Run(rcpt)
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 || fmt.Sprint(r[0]) != expect {
+				t.Logf("expected=%s,got=%v", expect, r)
+				t.Fail()
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		"average([lines.name])",
+		"max(1, [lines.name])",
+		"mode(1, 2, 3)",
+		"var(1)",
+		"stdev([lines.name])",
+	} {
+		t.Run(bad, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(bad); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			if _, err := l.Run(rcpt); err == nil {
+				t.Logf("expected an error from running")
+				t.Fail()
+			}
+		})
+	}
+
+	empty := &Receipt{Lines: &[]Product{}}
+	for k, expect := range map[string]interface{}{
+		"sum([lines.price])":     int64(0),
+		"count([lines.price])":   int64(0),
+		"min([lines.price])":     int64(0),
+		"product([lines.price])": int64(0),
+		"average([lines.price])": nil,
+		"median([lines.price])":  nil,
+		"stdev([lines.price])":   nil,
+	} {
+		t.Run("empty "+k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			r, err := l.Run(empty)
+			if expect == nil {
+				if err == nil {
+					t.Logf("expected an error for no numbers, got=%v", r)
+					t.Fail()
+				}
+				return
+			}
+			if err != nil || len(r) != 1 || r[0] != expect {
+				t.Logf("expected=%v,got=%v (%v)", expect, r, err)
+				t.Fail()
+			}
+		})
+	}
+
+	exact := fieldCalculator.NewParser(fieldCalculator.WithExactDecimals())
+	if err := exact.Parse("average([lines.price]) = 2.22 && var(0.1, 0.2, 0.3) = 0.01"); err != nil {
+		t.Logf("error compiling:%v", err)
+		t.FailNow()
+	}
+	if r, err := exact.Run(rcpt); err != nil || len(r) != 1 || r[0] != true {
+		t.Logf("aggregates should be exact in decimal mode, got=%v (%v)", r, err)
+		t.Fail()
+	}
+}
+
+func TestEvaluator_Criteria(t *testing.T) {
+	rcpt := &Receipt{
+		Lines: (&[]Product{
+			*&Product{Name: "Prod 1", Price: 5},
+			*&Product{Name: "Prod 2", Price: 12.5},
+			*&Product{Name: "Service", Price: 20},
+			*&Product{Name: "prod 10", Price: 10},
+		}),
+	}
+	OK := map[string]string{
+		"sumif([lines.price], '>10')":                                         "32.5",
+		"sumif([lines.price], 10)":                                            "10",
+		"sumif([lines.price], '<>10')":                                        "37.5",
+		"sumif([lines.name], 'Prod*', [lines.price])":                         "27.5",
+		"sumif([lines.name], 'prod ?', [lines.price])":                        "17.5",
+		"sumif([lines.name], '<>prod*', [lines.price])":                       "20",
+		"sumif([lines.price], [lines.price] > 10)":                            "32.5",
+		"sumif([lines.price], '>100')":                                        "0",
+		"sumifs([lines.price], [lines.name], 'Prod*', [lines.price], '>=10')": "22.5",
+		"sumifs([lines.price], [lines.price], '>5', [lines.price], '<20')":    "22.5",
+		"countif([lines.name], 'Prod*')":                                      "3",
+		"countif([lines.price], '>=10')":                                      "3",
+		"countif([lines.name], 'Service')":                                    "1",
+		"countifs([lines.name], '*1*', [lines.price], '<10')":                 "1",
+		"averageif([lines.price], '>5')":                                      "14.166666666666666",
+		"averageif([lines.name], 'Prod*', [lines.price])":                     "9.166666666666666",
+		"averageifs([lines.price], [lines.name], '<>Service')":                "9.166666666666666",
+		"maxifs([lines.price], [lines.name], 'Prod*')":                        "12.5",
+		"minifs([lines.price], [lines.name], 'Prod*', [lines.price], '>5')":   "10",
+		"maxifs([lines.price], [lines.name], 'nothing')":                      "0",
+		"countif([lines.name], '>Q')":                                         "1",
+		"countif([lines.name], '~*')":                                         "0",
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			r, err := l.Run(rcpt)
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 || fmt.Sprint(r[0]) != expect {
+				t.Logf("expected=%s,got=%v", expect, r)
+				t.Fail()
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		"sumifs([lines.price], sumif([lines.price], '>1'), 'Prod*')",
+		"countifs([lines.name], 'Prod*', 1, '>1')",
+		"sumif([lines.price], [lines.name], [lines.price])",
+		"sumif([lines.name], 'Prod*')",
+		"averageif([lines.price], '>100')",
+	} {
+		t.Run(bad, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(bad); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			if _, err := l.Run(rcpt); err == nil {
+				t.Logf("expected an error from running")
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestEvaluator_Text(t *testing.T) {
+	rcpt := &Receipt{
+		Lines: (&[]Product{
+			*&Product{Name: "crème brûlée", Price: 1.5},
+			*&Product{Name: "日本語テキスト", Price: 2},
+			*&Product{Name: "", Price: 3},
+		}),
+	}
+	prod := &Product{Name: "  hello   wide  world ", Price: 12.5}
+	OK := map[string]string{
+		"concat([name], '|', [price])":                          "  hello   wide  world |12.5",
+		"concat('a', 1, 2.5)":                                   "a12.5",
+		"textjoin(', ', 1, 'a', '', 'b')":                       "a, b",
+		"textjoin('-', 0, 'a', '', 'b')":                        "a--b",
+		"len([name])":                                           "22",
+		"len(trim([name]))":                                     "16",
+		"trim([name])":                                          "hello wide world",
+		"upper(trim([name]))":                                   "HELLO WIDE WORLD",
+		"proper(trim([name]))":                                  "Hello Wide World",
+		"lower('ÀÉÎ')":                                          "àéî",
+		"left('abc')":                                           "a",
+		"left('abc', 10)":                                       "abc",
+		"right('abc', 2)":                                       "bc",
+		"mid('abcdef', 2, 3)":                                   "bcd",
+		"mid('abc', 5, 1)":                                      "",
+		"substitute('a-b-c', '-', '+')":                         "a+b+c",
+		"substitute('a-b-c', '-', '+', 2)":                      "a-b+c",
+		"substitute('a-b-c', '-', '+', 3)":                      "a-b-c",
+		"replace('abcdef', 2, 3, 'XY')":                         "aXYef",
+		"find('b', 'abcb')":                                     "2",
+		"find('b', 'abcb', 3)":                                  "4",
+		"find('B', 'abcB')":                                     "4",
+		"search('B', 'abcb')":                                   "2",
+		"search('c?b', 'abcdb')":                                "3",
+		"rept('ab', 3)":                                         "ababab",
+		"exact('a', 'a')":                                       "true",
+		"exact('a', 'A')":                                       "false",
+		"len(12.5)":                                             "4",
+		"textjoin(';', 1, [lines.name])":                        "crème brûlée;日本語テキスト",
+		"textjoin(';', 1, len([lines.name]))":                   "12;7;0",
+		"textjoin(';', 1, left([lines.name], 3))":               "crè;日本語",
+		"textjoin(';', 1, right([lines.name], 2))":              "ée;スト",
+		"textjoin(';', 1, mid([lines.name], 2, [lines.price]))": "r;本語",
+		"find('é', 'brûlée')":                                   "5",
+		"upper(left([name], 3))":                                "  H",
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			var r []interface{}
+			var err error
+			if strings.Contains(k, "lines") {
+				r, err = l.Run(rcpt)
+			} else {
+				r, err = l.Run(prod)
+			}
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 || fmt.Sprint(r[0]) != expect {
+				t.Logf("expected=%s,got=%v", expect, r)
+				t.Fail()
+			}
+		})
+	}
+
+	for bad, msg := range map[string]string{
+		"find('z', 'abc')":                  "",
+		"find('a', 'abc', 5)":               "",
+		"search('z*', 'abc')":               "",
+		"mid('abc', 0, 1)":                  "must be at least 1",
+		"left('abc', -1)":                   "must be at least 0",
+		"rept('ab', 100000)":                "",
+		"textjoin([name], 1, 'a')":          "",
+		"substitute('a-b-c', '-', '+', 0)":  "SUBSTITUTE argument 4 must be at least 1",
+		"substitute('a-b-c', '-', '+', -1)": "must be at least 1",
+		"left('abc', 3000000000)":           "LEFT argument 2 must be at most 2147483647",
+	} {
+		t.Run(bad, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(bad); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			if _, err := l.Run(rcpt); err == nil || !strings.Contains(err.Error(), msg) {
+				t.Logf("expected an error from running containing %q, got=%v", msg, err)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestEvaluator_Strings(t *testing.T) {
+	OK := map[string]string{
+		`"escaped \" q"`:          `escaped " q`,
+		`'it\'s'`:                 `it's`,
+		`"say ""hi"""`:            `say "hi"`,
+		`'it''s'`:                 `it's`,
+		`"a\nb\tc\rd"`:            "a\nb\tc\rd",
+		`"ends in \\"`:            `ends in \`,
+		`'\\'`:                    `\`,
+		`"caf\u00e9"`:             "café",
+		`"naïve ☕"`:               "naïve ☕",
+		`""`:                      "",
+		`len("\u00e9\u00e9")`:     "2",
+		`proper('o\'neil-smith')`: "O'Neil-Smith",
+		"concat(\"a\",\u00a0'b')": "ab",
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			r, err := l.Run(&Product{})
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 || fmt.Sprint(r[0]) != expect {
+				t.Logf("expected=%q,got=%q", expect, r)
+				t.Fail()
+			}
+			again := fieldCalculator.NewParser()
+			if err := again.Parse(l.Format()); err != nil {
+				t.Logf("format does not parse back:%s (%v)", l.Format(), err)
+				t.FailNow()
+			}
+			if r2, err := again.Run(&Product{}); err != nil || fmt.Sprint(r2[0]) != expect {
+				t.Logf("format changed the value: %s gave %q", l.Format(), r2)
+				t.Fail()
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		`"unterminated`,
+		`"escaped end\"`,
+		`"bad \q escape"`,
+		`"short \u12"`,
+		`'trailing \`,
+	} {
+		t.Run(bad, func(t *testing.T) {
+			err := fieldCalculator.NewParser().Parse(bad)
+			var pe *fieldCalculator.ParseError
+			if !errors.As(err, &pe) {
+				t.Logf("expected a ParseError, got=%v", err)
+				t.Fail()
+			}
+		})
+	}
+
+	env := fieldCalculator.NewEnv(fieldCalculator.DefaultEnv)
+	env.RegisterFunction("größe", 1, 1, nil, func(ts []fieldCalculator.Token) (fieldCalculator.Token, error) {
+		return fieldCalculator.Token{Type: fieldCalculator.Static, Value: "ok"}, nil
+	})
+	l := fieldCalculator.NewParser(fieldCalculator.WithEnv(env))
+	if err := l.Parse("Größe(1) + ÉTÉ(2)"); err == nil {
+		t.Logf("ÉTÉ is not registered and should not parse")
+		t.Fail()
+	}
+	if err := l.Parse("GRÖßE(1)"); err != nil {
+		t.Logf("unicode function names should parse:%v", err)
+		t.Fail()
+	}
+}
+
+func TestEvaluator_NumberLiterals(t *testing.T) {
+	OK := map[string]interface{}{
+		"1e-3":         0.001,
+		"2.5E2":        250.0,
+		"1e+2 * 2":     200.0,
+		".5":           0.5,
+		"-.5":          -0.5,
+		"1 + .25":      1.25,
+		"12%":          0.12,
+		"7%":           0.07,
+		"200 * 15%":    30.0,
+		"-50%":         -0.5,
+		"1_000_000":    int64(1000000),
+		"1_000.000_1":  1000.0001,
+		"0x1F":         int64(31),
+		"0XfF + 1":     int64(256),
+		"0x7FFF_FFFF":  int64(math.MaxInt32),
+		"3.":           3.0,
+		"sum(1e1, .5)": 10.5,
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			r, err := l.Run(&Product{})
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 || r[0] != expect {
+				t.Logf("expected=%v (%T),got=%v", expect, expect, r)
+				t.Fail()
+			}
+			again := fieldCalculator.NewParser()
+			if err := again.Parse(l.Format()); err != nil {
+				t.Logf("format does not parse back:%s (%v)", l.Format(), err)
+				t.Fail()
+			}
+		})
+	}
+
+	exact := fieldCalculator.NewParser(fieldCalculator.WithExactDecimals())
+	if err := exact.Parse("12.5% + 0x10 + 1_000.1 + 1e-2"); err != nil {
+		t.Logf("error compiling:%v", err)
+		t.FailNow()
+	}
+	if r, err := exact.Run(&Product{}); err != nil || r[0].(*big.Rat).RatString() != "203247/200" {
+		t.Logf("expected=203247/200,got=%v (%v)", r, err)
+		t.Fail()
+	}
+
+	for k, token := range map[string]string{
+		"1.2.3":       "1.2.3",
+		"1 + 2abc":    "2abc",
+		"1e":          "1e",
+		"1e+":         "1e+",
+		"1__0":        "1__0",
+		"1_":          "1_",
+		"0x":          "0x",
+		"0x1G":        "0x1G",
+		"5%%":         "5%%",
+		"sum(1, 2.x)": "2.x",
+	} {
+		t.Run(k, func(t *testing.T) {
+			err := fieldCalculator.NewParser().Parse(k)
+			var pe *fieldCalculator.ParseError
+			if !errors.As(err, &pe) {
+				t.Logf("expected a ParseError, got=%v", err)
+				t.FailNow()
+			}
+			if pe.Token != token || !strings.HasPrefix(pe.Message, "Malformed number") {
+				t.Logf("expected a malformed number at %q, got=%v", token, pe)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestEvaluator_Booleans(t *testing.T) {
+	rcpt := &Receipt{
+		Lines: (&[]Product{
+			*&Product{Name: "Prod 1", Price: 1},
+			*&Product{Name: "TRUE", Price: 2},
+		}),
+	}
+	OK := map[string]interface{}{
+		"TRUE":                        true,
+		"false":                       false,
+		"True && not(FALSE)":          true,
+		"if(true, 1, 2)":              int64(1),
+		"if('false', 1, 2)":           int64(2),
+		"if(0, 1, 2)":                 int64(2),
+		"if(null(), 1, 2)":            int64(2),
+		"if(2.5, 'yes', 'no')":        "yes",
+		"true = (1 < 2)":              true,
+		"sumif([lines.price], TRUE)":  3.0,
+		"sumif([lines.price], FALSE)": 0.0,
+		"sumif([lines.price], TRUE, [lines.price])":   0.0,
+		"countif([lines.name], TRUE)":                 int64(0),
+		"NULL()":                                      nil,
+		"blank()":                                     nil,
+		"isblank(null())":                             true,
+		"isblank('')":                                 false,
+		"isnumber(1.5)":                               true,
+		"isnumber('1.5')":                             false,
+		"istext('x')":                                 true,
+		"istext(1)":                                   false,
+		"islogical(FALSE)":                            true,
+		"islogical(0)":                                false,
+		"and(isnumber([lines.price]))":                true,
+		"or(istext([lines.price]))":                   false,
+		"counta(null(), 1, blank())":                  int64(1),
+		"countblank(null(), '', 1)":                   int64(2),
+		"concat(TRUE, '/', null(), '/', 1)":           "TRUE//1",
+		"sumif([lines.price], [lines.name] = 'TRUE')": 2.0,
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			r, err := l.Run(rcpt)
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 || r[0] != expect {
+				t.Logf("expected=%v,got=%v", expect, r)
+				t.Fail()
+			}
+			again := fieldCalculator.NewParser()
+			if err := again.Parse(l.Format()); err != nil {
+				t.Logf("format does not parse back:%s (%v)", l.Format(), err)
+				t.Fail()
+			}
+		})
+	}
+
+	for _, bad := range []string{
+		"if('maybe', 1, 2)",
+		"not('x')",
+		"sum(TRUE)",
+		"TRUE()",
+		"null(1)",
+	} {
+		t.Run(bad, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(bad); err != nil {
+				return
+			}
+			if _, err := l.Run(rcpt); err == nil {
+				t.Logf("expected an error")
+				t.Fail()
+			}
+		})
+	}
+}
+
+type Shipment struct {
+	Weight  *float64
+	Boxes   []int
+	Label   *string
+	Receipt *Receipt
+}
+
+func TestEvaluator_Blanks(t *testing.T) {
+	weight := 2.5
+	records := []interface{}{
+		&Shipment{Weight: &weight, Boxes: []int{1, 2}, Receipt: &Receipt{Lines: &[]Product{{Price: 4}}}},
+		&Shipment{Receipt: &Receipt{}},
+		&Shipment{},
+	}
+	OK := map[string][]interface{}{
+		"[weight]":                           {2.5, nil, nil},
+		"[weight] * 2":                       {5.0, int64(0), int64(0)},
+		"[weight] + 1":                       {3.5, int64(1), int64(1)},
+		"-[weight]":                          {-2.5, int64(0), int64(0)},
+		"round([weight])":                    {3.0, int64(0), int64(0)},
+		"[weight] = 0":                       {false, true, true},
+		"[label] = ''":                       {true, true, true},
+		"concat('#', [label])":               {"#", "#", "#"},
+		"sum([boxes])":                       {int64(3), int64(0), int64(0)},
+		"count([boxes])":                     {int64(2), int64(0), int64(0)},
+		"sum([receipt.lines.price])":         {4.0, int64(0), int64(0)},
+		"counta([receipt.lines.name])":       {int64(1), int64(0), int64(0)},
+		"average([weight], 1.5)":             {2.0, 1.5, 1.5},
+		"isblank([weight])":                  {false, true, true},
+		"null() + 1":                         {int64(1), int64(1), int64(1)},
+		"sumif([boxes], [boxes] > 1)":        {int64(2), int64(0), int64(0)},
+		"if(isblank([weight]), 'n/a', 'ok')": {"ok", "n/a", "n/a"},
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			if ok, _ := l.AppliesTo(records...); !ok {
+				t.Logf("expected the field to apply")
+				t.Fail()
+			}
+			r, err := l.Run(records...)
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if fmt.Sprint(r) != fmt.Sprint(expect) {
+				t.Logf("expected=%v,got=%v", expect, r)
+				t.Fail()
+			}
+		})
+	}
+
+	for k, msg := range map[string]string{
+		"[receipt.nope]":                 "Field is unresolveable",
+		"[weight.value]":                 "Field is unresolveable",
+		"average([receipt.lines.price])": "AVERAGE of no numbers",
+	} {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			if _, err := l.Run(records[1]); err == nil || !strings.Contains(err.Error(), msg) {
+				t.Logf("expected error %q, got=%v", msg, err)
+				t.Fail()
+			}
+		})
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		l := fieldCalculator.NewParser(fieldCalculator.WithStrictFields())
+		if err := l.Parse("sum([receipt.lines.price])"); err != nil {
+			t.Logf("error compiling:%v", err)
+			t.FailNow()
+		}
+		if r, err := l.Run(records[0]); err != nil || fmt.Sprint(r) != "[4]" {
+			t.Logf("expected [4], got=%v (%v)", r, err)
+			t.Fail()
+		}
+		_, err := l.Run(records[0], records[1])
+		var ee *fieldCalculator.EvalError
+		if !errors.As(err, &ee) || ee.Message != "Field is blank" || ee.Record != 1 || ee.Path != "receipt.lines.price" {
+			t.Logf("expected a blank field error for record 1, got=%v", err)
+			t.Fail()
+		}
+	})
+}
+
+type Event struct {
+	Kind    string
+	Payload json.RawMessage
+	Attrs   map[string]interface{}
+}
+
+func TestEvaluator_Documents(t *testing.T) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"id": "r1", "Total": 10, "lines": [{"price": 1.5, "qty": 2}, {"price": 2.5, "qty": 1, "tags": ["a", "b"]}], "customer": {"name": "Ann"}}`), &doc); err != nil {
+		t.Logf("err=%v", err)
+		t.FailNow()
+	}
+	event := &Event{
+		Kind:    "order",
+		Payload: json.RawMessage(`{"lines": [{"price": 3, "qty": 2}, {"price": 4, "qty": 1}], "note": null}`),
+		Attrs:   map[string]interface{}{"color": "red", "sizes": []interface{}{1, 2, 3}},
+	}
+	records := map[string]interface{}{
+		"map":   doc,
+		"event": event,
+		"mixed": []map[string]interface{}{{"price": 1}, {"price": json.Number("2")}},
+	}
+	OK := map[string]struct {
+		record string
+		expect interface{}
+	}{
+		"sum([lines.price])":         {"map", 4.0},
+		"[total] + 1":                {"map", 11.0},
+		"[customer.name]":            {"map", "Ann"},
+		"counta([lines.tags])":       {"map", int64(2)},
+		"isblank([customer.email])":  {"map", true},
+		"sum([payload.lines.price])": {"event", int64(7)},
+		"sumif([payload.lines.price], [payload.lines.qty] > 1)": {"event", int64(3)},
+		"isblank([payload.note])":                               {"event", true},
+		"concat([kind], ':', [attrs.color])":                    {"event", "order:red"},
+		"sum([attrs.sizes])":                                    {"event", int64(6)},
+		"sum([price])":                                          {"mixed", int64(3)},
+	}
+	for k, c := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			if ok, _ := l.AppliesTo(records[c.record]); !ok {
+				t.Logf("expected the field to apply")
+				t.Fail()
+			}
+			r, err := l.Run(records[c.record])
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 || r[0] != c.expect {
+				t.Logf("expected=%v (%T),got=%v", c.expect, c.expect, r)
+				t.Fail()
+			}
+		})
+	}
+
+	for k, expect := range map[string]int64{
+		"countif([customer], [customer])": 1,
+		"countif([attrs], [attrs])":       1,
+		"countif([customer], 'x')":        0,
+		"countifs([lines], [lines[0]])":   1,
+	} {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			record := interface{}(doc)
+			if strings.Contains(k, "attrs") {
+				record = event
+			}
+			r, err := l.Run(record)
+			if err != nil || len(r) != 1 || r[0] != expect {
+				t.Logf("expected=%v,got=%v (%v)", expect, r, err)
+				t.Fail()
+			}
+		})
+	}
+
+	l := fieldCalculator.NewParser(fieldCalculator.WithStrictFields())
+	l.Parse("[customer.email]")
+	if _, err := l.Run(doc); err == nil {
+		t.Logf("strict mode should reject missing keys")
+		t.Fail()
+	}
+	l = fieldCalculator.NewParser()
+	l.Parse("[payload.price]")
+	if _, err := l.Run(&Event{Payload: json.RawMessage(`{"price":`)}); err == nil {
+		t.Logf("malformed JSON should be an error")
+		t.Fail()
+	}
+}
+
+type Audit struct {
+	CreatedBy string `json:"created_by"`
+	Revision  int
+}
+
+type Money struct {
+	Currency string
+	Cents    int64 `json:"cents"`
+}
+
+type Invoice struct {
+	Audit
+	*Money
+	LineItems []InvoiceLine `json:"line_items"`
+	Secret    string        `calc:"-"`
+	Internal  string        `json:"-"`
+	Total     float64       `calc:"grand_total" json:"total"`
+	margin    float64
+}
+
+type InvoiceLine struct {
+	UnitPrice float64 `json:"unit_price,omitempty"`
+	Qty       int
+}
+
+func TestEvaluator_FieldNames(t *testing.T) {
+	invoice := &Invoice{
+		Audit:     Audit{CreatedBy: "ann", Revision: 2},
+		Money:     &Money{Currency: "EUR", Cents: 1250},
+		LineItems: []InvoiceLine{{UnitPrice: 1.5, Qty: 2}, {UnitPrice: 2, Qty: 1}},
+		Secret:    "s3cret",
+		Internal:  "x",
+		Total:     5,
+		margin:    0.5,
+	}
+	cases := map[string]struct {
+		opts   []fieldCalculator.ParserOption
+		expect interface{}
+	}{
+		"sum([lineitems.unitprice])":   {nil, 3.5},
+		"[grand_total]":                {nil, 5.0},
+		"[revision] + 1":               {nil, int64(3)},
+		"[audit.revision]":             {nil, int64(2)},
+		"[cents] / 50":                 {nil, int64(25)},
+		"[money.currency]":             {nil, "EUR"},
+		"[internal]":                   {nil, "x"},
+		"sum([line_items.unit_price])": {[]fieldCalculator.ParserOption{fieldCalculator.WithTagKey("json")}, 3.5},
+		"[created_by]":                 {[]fieldCalculator.ParserOption{fieldCalculator.WithTagKey("json")}, "ann"},
+		"[TOTAL]":                      {[]fieldCalculator.ParserOption{fieldCalculator.WithTagKey("json")}, 5.0},
+		"[cents] + [revision]":         {[]fieldCalculator.ParserOption{fieldCalculator.WithTagKey("json")}, int64(1252)},
+		"sum([LineItems.UnitPrice])":   {[]fieldCalculator.ParserOption{fieldCalculator.WithCaseSensitiveFields()}, 3.5},
+		"sum([line_items.Qty])":        {[]fieldCalculator.ParserOption{fieldCalculator.WithTagKey("json"), fieldCalculator.WithCaseSensitiveFields()}, int64(3)},
+	}
+	for k, c := range cases {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser(c.opts...)
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			if ok, _ := l.AppliesTo(invoice); !ok {
+				t.Logf("expected the field to apply")
+				t.Fail()
+			}
+			r, err := l.Run(invoice)
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 || r[0] != c.expect {
+				t.Logf("expected=%v (%T),got=%v", c.expect, c.expect, r)
+				t.Fail()
+			}
+		})
+	}
+
+	unresolvable := map[string][]fieldCalculator.ParserOption{
+		"[secret]":                nil,
+		"[margin]":                nil,
+		"[total]":                 nil,
+		"[internal]":              {fieldCalculator.WithTagKey("json")},
+		"[line_items.Unit_Price]": {fieldCalculator.WithTagKey("json"), fieldCalculator.WithCaseSensitiveFields()},
+		"[revision]":              {fieldCalculator.WithCaseSensitiveFields()},
+	}
+	for k, opts := range unresolvable {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser(opts...)
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			if ok, _ := l.AppliesTo(invoice); ok {
+				t.Logf("expected the field not to apply")
+				t.Fail()
+			}
+			if _, err := l.Run(invoice); err == nil || !strings.Contains(err.Error(), "Field is unresolveable") {
+				t.Logf("expected an unresolveable field, got=%v", err)
+				t.Fail()
+			}
+		})
+	}
+
+	l := fieldCalculator.NewParser()
+	l.Parse("[currency]")
+	if r, err := l.Run(&Invoice{}); err != nil || len(r) != 1 || r[0] != nil {
+		t.Logf("a nil embedded struct should be blank, got=%v (%v)", r, err)
+		t.Fail()
+	}
+
+	l = fieldCalculator.NewParser()
+	l.Parse("[grand_total] * 2")
+	bs, err := json.Marshal(l)
+	if err != nil {
+		t.Logf("error marshaling:%v", err)
+		t.FailNow()
+	}
+	loaded := &fieldCalculator.Evaluator{}
+	if err := json.Unmarshal(bs, loaded); err != nil {
+		t.Logf("error loading:%v", err)
+		t.FailNow()
+	}
+	if ok, _ := loaded.AppliesTo(invoice); !ok {
+		t.Logf("a zero-value Evaluator should name fields by their calc tag")
+		t.Fail()
+	}
+	if r, err := loaded.Run(invoice); err != nil || len(r) != 1 || r[0] != 10.0 {
+		t.Logf("expected=10,got=%v (%v)", r, err)
+		t.Fail()
+	}
+}
+
+func TestEvaluator_Paths(t *testing.T) {
+	rcpt := &Receipt{
+		Lines: (&[]Product{
+			*&Product{Name: "Prod 1", Price: 1},
+			*&Product{Name: "Prod 2", Price: 2},
+			*&Product{Name: "Prod 3", Price: 3},
+			*&Product{Name: "Prod 4", Price: 4},
+		}),
+	}
+	event := &Event{
+		Payload: json.RawMessage(`{"lines": [{"price": 3}, {"price": 4}], "a.b": 5, "odd]key": 6}`),
+		Attrs:   map[string]interface{}{"color": "red", "size": "xl", "Sizes": []interface{}{1, 2, 3}},
+	}
+	OK := map[string]struct {
+		record interface{}
+		expect interface{}
+	}{
+		"[lines[0].price]":           {rcpt, 1.0},
+		"[lines[-1].name]":           {rcpt, "Prod 4"},
+		"sum([lines[1:3].price])":    {rcpt, 5.0},
+		"sum([lines[:2].price])":     {rcpt, 3.0},
+		"sum([lines[-2:].price])":    {rcpt, 7.0},
+		"sum([lines[2:100].price])":  {rcpt, 7.0},
+		"count([lines[3:1].price])":  {rcpt, int64(0)},
+		"sum([lines[*].price])":      {rcpt, 10.0},
+		"isblank([lines[4].price])":  {rcpt, true},
+		"[lines[0][\"name\"]]":       {rcpt, "Prod 1"},
+		"[attrs[\"color\"]]":         {event, "red"},
+		"[attrs['size']]":            {event, "xl"},
+		"concat([attrs[*]])":         {event, "123redxl"},
+		"[attrs.sizes[-1]]":          {event, int64(3)},
+		"[payload.lines[1].price]":   {event, int64(4)},
+		"[payload[\"a.b\"]]":         {event, int64(5)},
+		"[payload[\"odd]key\"]] + 1": {event, int64(7)},
+	}
+	for k, c := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			if ok, err := l.AppliesTo(c.record); !ok || err != nil {
+				t.Logf("expected the field to apply (%v)", err)
+				t.Fail()
+			}
+			r, err := l.Run(c.record)
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			if len(r) != 1 || r[0] != c.expect {
+				t.Logf("expected=%v (%T),got=%v", c.expect, c.expect, r)
+				t.Fail()
+			}
+			again := fieldCalculator.NewParser()
+			if err := again.Parse(l.Format()); err != nil || again.Format() != l.Format() {
+				t.Logf("format does not parse back:%s (%v)", l.Format(), err)
+				t.Fail()
+			}
+		})
+	}
+
+	for _, bad := range []string{"[lines[0].nope]", "[lines.price[0]]", "[lines[\"0\"]]", "[attrs[0]]"} {
+		t.Run(bad, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(bad); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			if ok, _ := l.AppliesTo(rcpt, event); ok {
+				t.Logf("expected the field not to apply")
+				t.Fail()
+			}
+		})
+	}
+
+	for _, malformed := range []string{"[lines[x].price]", "[lines[0.price]", "[lines..price]", "[lines[1:2:3]]", "[]", "[lines.]", "[lines[0]price]"} {
+		t.Run(malformed, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			var pe *fieldCalculator.ParseError
+			if err := l.Parse(malformed); !errors.As(err, &pe) {
+				t.Logf("expected a parse error, got=%v", err)
+				t.Fail()
+			}
+		})
+	}
+}
+
+type Cart struct {
+	Items    []CartItem
+	Discount float64
+}
+
+type CartItem struct {
+	Price float64
+	Qty   int
+}
+
+var errNoRate = errors.New("no exchange rate")
+
+// Total has a value receiver
+func (i CartItem) Total() float64 {
+	return i.Price * float64(i.Qty)
+}
+
+// Subtotal has a pointer receiver
+func (c *Cart) Subtotal() float64 {
+	s := 0.0
+	for _, i := range c.Items {
+		s += i.Total()
+	}
+	return s
+}
+
+func (c *Cart) Largest() *CartItem {
+	if len(c.Items) == 0 {
+		return nil
+	}
+	return &c.Items[0]
+}
+
+func (c Cart) InEuro() (float64, error) {
+	if c.Discount < 0 {
+		return 0, errNoRate
+	}
+	return c.Subtotal() * 0.9, nil
+}
+
+func (c Cart) Boom() int {
+	var m map[string]int
+	m["x"] = 1
+	return 0
+}
+
+func (c Cart) Scale(f float64) float64 {
+	return f
+}
+
+func TestEvaluator_Methods(t *testing.T) {
+	cart := Cart{Items: []CartItem{{Price: 1.5, Qty: 2}, {Price: 2, Qty: 1}}, Discount: 1}
+	OK := map[string]interface{}{
+		"[subtotal] - [discount]": 4.0,
+		"sum([items.total])":      5.0,
+		"[items[-1].total]":       2.0,
+		"[largest.qty]":           int64(2),
+		"[largest.total]":         3.0,
+		"round([ineuro], 2)":      4.5,
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser(fieldCalculator.WithMethods())
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			for _, record := range []interface{}{cart, &cart} {
+				r, err := l.Run(record)
+				if err != nil {
+					t.Logf("error in calc:%v", err)
+					t.FailNow()
+				}
+				if len(r) != 1 || r[0] != expect {
+					t.Logf("expected=%v (%T),got=%v (%T)", expect, expect, r, record)
+					t.Fail()
+				}
+			}
+		})
+	}
+
+	for k, opts := range map[string][]fieldCalculator.ParserOption{
+		"[subtotal]": nil,
+		"[scale]":    {fieldCalculator.WithMethods()},
+		"[nope]":     {fieldCalculator.WithMethods()},
+	} {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser(opts...)
+			l.Parse(k)
+			if ok, _ := l.AppliesTo(&cart); ok {
+				t.Logf("expected the field not to apply")
+				t.Fail()
+			}
+			if _, err := l.Run(&cart); err == nil {
+				t.Logf("expected an error")
+				t.Fail()
+			}
+		})
+	}
+
+	l := fieldCalculator.NewParser(fieldCalculator.WithMethods())
+	l.Parse("[cart.subtotal]")
+	if r, err := l.Run(map[string]interface{}{"cart": cart}); err != nil || len(r) != 1 || r[0] != 5.0 {
+		t.Logf("pointer receivers should work on values held in maps, got=%v (%v)", r, err)
+		t.Fail()
+	}
+	l = fieldCalculator.NewParser(fieldCalculator.WithMethods())
+	l.Parse("[ineuro] + 1")
+	_, err := l.Run(&cart, &Cart{Discount: -1})
+	var ee *fieldCalculator.EvalError
+	if !errors.As(err, &ee) || !errors.Is(err, errNoRate) || ee.Record != 1 || ee.Path != "ineuro" {
+		t.Logf("method errors should fail the evaluation, got=%v", err)
+		t.Fail()
+	}
+	l = fieldCalculator.NewParser(fieldCalculator.WithMethods())
+	l.Parse("[boom]")
+	if _, err := l.Run(&cart); err == nil || !strings.Contains(err.Error(), "Method Boom failed") {
+		t.Logf("method panics should fail the evaluation, got=%v", err)
+		t.Fail()
+	}
+	l = fieldCalculator.NewParser(fieldCalculator.WithMethods())
+	l.Parse("[largest.total]")
+	if r, err := l.Run(&Cart{}); err != nil || len(r) != 1 || r[0] != nil {
+		t.Logf("a nil result should be blank, got=%v (%v)", r, err)
+		t.Fail()
+	}
+}
+
+func TestEvaluator_ASTRoundTrip(t *testing.T) {
+	prod := &Product{Name: "product \"1\"", Price: 65.25}
+	for _, k := range []string{
+		"sum([price]) * 0.2",
+		"([price] + 1) * -[price]",
+		"if([name] = 'product \"1\"', [name], 'other')",
+		"[price] > 1 && not([price] > 100)",
+	} {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			stored, err := json.Marshal(l)
+			if err != nil {
+				t.Logf("error marshaling:%v", err)
+				t.FailNow()
+			}
+			loaded := fieldCalculator.NewParser()
+			if err := json.Unmarshal(stored, loaded); err != nil {
+				t.Logf("error loading %s:%v", stored, err)
+				t.FailNow()
+			}
+			if loaded.AST() != l.AST() {
+				t.Logf("expected=%s,got=%s", l.AST(), loaded.AST())
+				t.Fail()
+			}
+			if applies, err := loaded.AppliesTo(prod); err != nil || !applies {
+				t.Logf("loaded formula should apply to prod:%v", err)
+				t.Fail()
+			}
+			want, err := l.Run(prod)
+			if err != nil {
+				t.Logf("error in calc:%v", err)
+				t.FailNow()
+			}
+			got, err := loaded.Run(prod)
+			if err != nil {
+				t.Logf("error in loaded calc:%v", err)
+				t.FailNow()
+			}
+			if len(got) != 1 || got[0] != want[0] {
+				t.Logf("expected=%v,got=%v", want, got)
+				t.Fail()
+			}
+		})
+	}
+
+	if n, ok := fieldCalculator.NewParser().Tree().(*fieldCalculator.FuncCallNode); ok || n != nil {
+		t.Logf("nothing parsed should have no tree")
+		t.Fail()
+	}
+	for _, bad := range []string{
+		`{"type":"func","name":"nope","args":[]}`,
+		`{"type":"func","name":"sum","args":[]}`,
+		`{"type":"literal","kind":"date","value":"2021-01-01"}`,
+		`{"type":"whatever"}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), fieldCalculator.NewParser()); err == nil {
+			t.Logf("expected an error loading %s", bad)
+			t.Fail()
+		}
+	}
+}
+
+// shape renders a tree without positions, redundant groups or name casing so equivalent trees compare equal
+func shape(n fieldCalculator.Node) string {
+	switch v := n.(type) {
+	case *fieldCalculator.FuncCallNode:
+		args := make([]string, 0, len(v.Args))
+		for _, a := range v.Args {
+			args = append(args, shape(a))
+		}
+		return strings.ToUpper(v.Name) + "(" + strings.Join(args, ",") + ")"
+	case *fieldCalculator.ScopeNode:
+		if len(v.Body) == 1 {
+			return shape(v.Body[0])
+		}
+		body := make([]string, 0, len(v.Body))
+		for _, b := range v.Body {
+			body = append(body, shape(b))
+		}
+		return "(" + strings.Join(body, ",") + ")"
+	case *fieldCalculator.FieldNode:
+		return "[" + v.Name + "]"
+	case *fieldCalculator.LiteralNode:
+		return fmt.Sprintf("%T:%v", v.Value, v.Value)
+	}
+	return "?"
+}
+
+func TestEvaluator_Format(t *testing.T) {
+	OK := map[string]string{
+		"sum( [lines.price] )*0.2":        "SUM([lines.price]) * 0.2",
+		"(((((((((([price]))))))))))":     "[price]",
+		"1 + (2 / 3)":                     "1 + 2 / 3",
+		"(1 + 2) / 3":                     "(1 + 2) / 3",
+		"10 - (2 - 3)":                    "10 - (2 - 3)",
+		"(10 - 2) - 3":                    "10 - 2 - 3",
+		"-(1 + 2) * 2":                    "-(1 + 2) * 2",
+		"1 - -1":                          "1 - -1",
+		"sumif([price],[price]>2)":        "SUMIF([price], [price] > 2)",
+		"if([a] > 1 && [b] <> 'x', 1, 2)": "IF([a] > 1 && [b] <> \"x\", 1, 2)",
+		"concat('say \"hi\"', \"!\")":     "CONCAT('say \"hi\"', \"!\")",
+		"not([a] = 1) || [b] >= 2 && [c]": "NOT([a] = 1) || [b] >= 2 && [c]",
+		"1 + 2 / 3 = (2 / 3) + 1":         "1 + 2 / 3 = 2 / 3 + 1",
+		"    5 +     6.1235566777":        "5 + 6.1235566777",
+		"2 ^ (3 ^ 2)":                     "2 ^ 3 ^ 2",
+		"(2 ^ 3) ^ 2":                     "(2 ^ 3) ^ 2",
+		"round([a]*2,1)":                  "ROUND([a] * 2, 1)",
+		"sum((1), ((2.5)))":               "SUM(1, 2.5)",
+		"concat(('a'), [b])":              "CONCAT(\"a\", [b])",
+		"if((TRUE), (1), 2)":              "IF(TRUE, 1, 2)",
+		"[a] / (2)":                       "[a] / 2",
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			if l.Format() != expect {
+				t.Logf("expected=%s,got=%s", expect, l.Format())
+				t.Fail()
+			}
+			again := fieldCalculator.NewParser()
+			if err := again.Parse(l.Format()); err != nil {
+				t.Logf("error compiling formatted:%v", err)
+				t.FailNow()
+			}
+			if shape(again.Tree()) != shape(l.Tree()) {
+				t.Logf("trees differ, expected=%s,got=%s", shape(l.Tree()), shape(again.Tree()))
+				t.Fail()
+			}
+			if again.String() != l.Format() {
+				t.Logf("format is not stable, expected=%s,got=%s", l.Format(), again.String())
+				t.Fail()
+			}
+		})
+	}
+}
+
+// TestEvaluator_FormatRoundTrip checks every formula Parse accepts formats to text Parse accepts again
+func TestEvaluator_FormatRoundTrip(t *testing.T) {
+	for _, k := range []string{
+		"-1 || IF(3, [price], 2 / (TRUE))",
+		"sum(('abc'))",
+		"sum((1), ('2'))",
+		"len((1))",
+		"upper((TRUE))",
+		"if(((FALSE)), (('x')), -(1))",
+		"(([a])) + ((1)) * (('2'))",
+		"not(('x'))",
+		"round((1.25), (1))",
+		"concat((NULL()), ((1)))",
+	} {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser()
+			if err := l.Parse(k); err != nil {
+				return
+			}
+			again := fieldCalculator.NewParser()
+			if err := again.Parse(l.Format()); err != nil {
+				t.Logf("format does not parse back:%s (%v)", l.Format(), err)
+				t.Fail()
+			} else if again.Format() != l.Format() {
+				t.Logf("format is not stable, expected=%s,got=%s", l.Format(), again.Format())
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestEvaluator_ParseErrors(t *testing.T) {
+	for _, bad := range []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 + 2)",
+		"1 2",
+		"sum(1 2)",
+		"sum(1,)",
+		"sum",
+		"nope(1)",
+		"* 2",
+		"[price",
+		"'open",
+		"1 # 2",
+		"sum('abc')",
+		"sum(('abc'))",
+		"sum(((('abc'))))",
+		"2 / TRUE",
+		"2 / (TRUE)",
+		"ifs(1, 2, 3)",
+		"ifs(1 > 2, 1, 3)",
+		"sumifs([price], [name], 'a*', [price])",
+		"countifs([name], 'a*', [price])",
+		"averageifs([price], [name], 'a*', [price])",
+		"maxifs([price], [name], 'a*', [price])",
+		"minifs([price], [name], 'a*', [price])",
+	} {
+		t.Run(bad, func(t *testing.T) {
+			if err := fieldCalculator.NewParser().Parse(bad); err == nil {
+				t.Logf("expected a parse error")
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestEvaluator_ParseErrorPosition(t *testing.T) {
+	type expectation struct {
+		offset, line, column int
+		token, rendered      string
+	}
+	OK := map[string]expectation{
+		"sum([price],\n  nope(1))": {15, 2, 3, "nope", "Unknown function or token: 'nope' @ line 2, character 3\n  nope(1))\n  ^"},
+		"1 +":                      {3, 1, 4, "", "Unexpected end of formula, expected a number or a string or a boolean or a [field] or a function or '(' or '-' @ line 1, character 4\n1 +\n   ^"},
+		"SUM()":                    {0, 1, 1, "SUM", "SUM expects at least 1 argument(s), got 0 @ line 1, character 1\nSUM()\n^"},
+		"if(1 > 2,\t1 2)":          {12, 1, 13, "2", "Unexpected '2' in arguments of if, expected ',' or ')' @ line 1, character 13\nif(1 > 2,\t1 2)\n         \t  ^"},
+		"'é' + [é":                 {7, 1, 7, "[é", "Unterminated field, expected ']' @ line 1, character 7\n'é' + [é\n      ^"},
+		"1 + ifs(1, 2, 3)":         {4, 1, 5, "ifs", "Expects pairs of condition and value, got 3 argument(s) @ line 1, character 5\n1 + ifs(1, 2, 3)\n    ^"},
+	}
+	for k, expect := range OK {
+		t.Run(k, func(t *testing.T) {
+			err := fieldCalculator.NewParser().Parse(k)
+			var pe *fieldCalculator.ParseError
+			if !errors.As(err, &pe) {
+				t.Logf("expected a ParseError, got=%v", err)
+				t.FailNow()
+			}
+			if pe.Offset != expect.offset || pe.Line != expect.line || pe.Column != expect.column || pe.Token != expect.token {
+				t.Logf("expected=%d:%d:%d:%q,got=%d:%d:%d:%q", expect.offset, expect.line, expect.column, expect.token, pe.Offset, pe.Line, pe.Column, pe.Token)
+				t.Fail()
+			}
+			if pe.Error() != expect.rendered {
+				t.Logf("expected=%q,got=%q", expect.rendered, pe.Error())
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestEvaluator_EvalError(t *testing.T) {
+	rcpt := &Receipt{
+		Lines: (&[]Product{
+			*&Product{Name: "Prod 1", Price: 1.11},
+		}),
+	}
+	type expectation struct {
+		fn               string
+		arg              int
+		goType, path     string
+		position, record int
+	}
+	sentinel := errors.New("tenant function failed")
+	env := fieldCalculator.NewEnv(fieldCalculator.DefaultEnv)
+	env.RegisterFunction("fail", 1, 1, nil, func(ts []fieldCalculator.Token) (fieldCalculator.Token, error) {
+		return fieldCalculator.Token{}, sentinel
+	})
+	OK := map[string]struct {
+		records []interface{}
+		expect  expectation
+	}{
+		"sum([lines.name])":         {[]interface{}{rcpt}, expectation{"sum", 0, "string", "lines.name", 4, 0}},
+		"10 / [price]":              {[]interface{}{&Product{Price: 2}, &Product{}}, expectation{"/", 1, "float64", "price", 5, 1}},
+		"1 + [nope]":                {[]interface{}{&Product{}}, expectation{"", -1, "*fieldcalculator_test.Product", "nope", 4, 0}},
+		"if([name], 1, 2)":          {[]interface{}{&Product{Name: "x"}}, expectation{"if", 0, "string", "name", 3, 0}},
+		"1 + fail(sum([price], 1))": {[]interface{}{&Product{}}, expectation{"fail", -1, "", "", 4, 0}},
+		"-((([name])))":             {[]interface{}{&Product{}}, expectation{"-", 0, "string", "name", 4, 0}},
+	}
+	for k, c := range OK {
+		t.Run(k, func(t *testing.T) {
+			l := fieldCalculator.NewParser(fieldCalculator.WithEnv(env))
+			if err := l.Parse(k); err != nil {
+				t.Logf("error compiling:%v", err)
+				t.FailNow()
+			}
+			_, err := l.Run(c.records...)
+			var ee *fieldCalculator.EvalError
+			if !errors.As(err, &ee) {
+				t.Logf("expected an EvalError, got=%v", err)
+				t.FailNow()
+			}
+			got := expectation{ee.Func, ee.ArgIndex, ee.GoType, ee.Path, ee.Position, ee.Record}
+			if got != c.expect {
+				t.Logf("expected=%+v,got=%+v (%v)", c.expect, got, ee)
+				t.Fail()
+			}
+		})
+	}
+
+	l := fieldCalculator.NewParser()
+	l.Parse("IFS(1 > 2, 1)")
+	if _, err := l.Run(&Product{}); err == nil || strings.Count(err.Error(), "IFS") != 1 || !strings.HasPrefix(err.Error(), "No condition is true in IFS") {
+		t.Logf("IFS should be named once, got=%v", err)
+		t.Fail()
+	}
+
+	l = fieldCalculator.NewParser(fieldCalculator.WithEnv(env))
+	l.Parse("fail(1)")
+	if _, err := l.Run(&Product{}); !errors.Is(err, sentinel) {
+		t.Logf("function errors should stay reachable with errors.Is, got=%v", err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,137 @@
+package fieldcalculator
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Format re-emits the parsed formula in canonical form, parentheses are only kept where
+// operatorPrecedence needs them so Parse(Format()) gives back an equivalent tree
+func (ev *Evaluator) Format() string {
+	if len(ev.Tokens) != 1 {
+		return ""
+	}
+	s, _ := formatToken(ev.Tokens[0])
+	return s
+}
+
+// String is the canonical form of the formula
+func (ev *Evaluator) String() string {
+	return ev.Format()
+}
+
+// formatToken renders t and returns the precedence it binds with
+func formatToken(t Token) (string, int) {
+	switch t.Type {
+	case Static:
+		return formatLiteral(t.Value), atomPrecedence
+	case Field:
+		return "[" + t.Value.(string) + "]", atomPrecedence
+	case Scope:
+		ts := t.Value.([]Token)
+		if len(ts) == 1 {
+			return formatToken(ts[0])
+		}
+		parts := make([]string, 0, len(ts))
+		for _, x := range ts {
+			s, _ := formatToken(x)
+			parts = append(parts, s)
+		}
+		return "(" + strings.Join(parts, ", ") + ")", atomPrecedence
+	case FuncScope:
+		ts := t.Value.([]Token)
+		name := ts[0].Value.(string)
+		if ts[0].Type != Operator {
+			args := make([]string, 0, len(ts)-1)
+			for _, x := range ts[1:] {
+				s, _ := formatToken(x)
+				args = append(args, s)
+			}
+			return strings.ToUpper(name) + "(" + strings.Join(args, ", ") + ")", atomPrecedence
+		}
+		if len(ts) == 2 {
+			// -(5) keeps the negation apart from the literal -5
+			if n := unwrapScope(ts[1]); n.Type == Static && !isNegativeNumber(n.Value) {
+				s, _ := formatToken(n)
+				return name + "(" + s + ")", prefixPrecedence
+			}
+			return name + formatOperand(ts[1], prefixPrecedence, false), prefixPrecedence
+		}
+		prec := operatorPrecedence[name]
+		right := rightAssociative[name]
+		return formatOperand(ts[1], prec, right) + " " + name + " " + formatOperand(ts[2], prec, !right), prec
+	}
+	return "", atomPrecedence
+}
+
+// formatOperand wraps an operand in parentheses when it binds looser than its operator,
+// an equal precedence needs them on the side the operator does not group towards
+func formatOperand(t Token, prec int, against bool) string {
+	s, p := formatToken(t)
+	if p < prec || (against && p == prec) {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+func formatLiteral(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		// single quotes save escaping when only double quotes appear in the string
+		if strings.Contains(x, "\"") && !strings.Contains(x, "'") {
+			return quoteString(x, '\'')
+		}
+		return quoteString(x, '"')
+	case bool:
+		if x {
+			return "TRUE"
+		}
+		return "FALSE"
+	case nil:
+		return "NULL()"
+	case float64:
+		// whole floats keep a decimal point so they parse back as floats
+		if s := formatValue(x); !strings.ContainsAny(s, ".eEIN") {
+			return s + ".0"
+		}
+	}
+	return formatValue(v)
+}
+
+// quoteString escapes s so parseStr reads it back unchanged
+func quoteString(s string, quote rune) string {
+	var b strings.Builder
+	b.WriteRune(quote)
+	for _, r := range s {
+		switch {
+		case r == quote || r == '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < ' ' || r == 0x7f:
+			b.WriteString(fmt.Sprintf(`\u%04x`, r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteRune(quote)
+	return b.String()
+}
+
+// unwrapScope strips groups holding a single token
+func unwrapScope(t Token) Token {
+	for t.Type == Scope && len(t.Value.([]Token)) == 1 {
+		t = t.Value.([]Token)[0]
+	}
+	return t
+}
+
+func isNegativeNumber(v interface{}) bool {
+	f, ok := ToFloat64(v)
+	return ok && f < 0
+}
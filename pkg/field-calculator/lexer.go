@@ -0,0 +1,304 @@
+package fieldcalculator
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type lexKind int8
+
+const (
+	lexEOF lexKind = iota
+	lexField
+	lexLiteral
+	lexIdent
+	lexOperator
+	lexOpen
+	lexClose
+	lexComma
+)
+
+// lexeme is one token of source text, literals, fields and operators carry their parsed Token
+type lexeme struct {
+	kind  lexKind
+	text  string
+	token Token
+	pos   int
+}
+
+var (
+	whitespace = regexp.MustCompile(`^[\t\r\n\p{Zs}]+`)
+	identifier = regexp.MustCompile(`^\pL[\pL\pN_]*`)
+)
+
+// lex splits a formula into lexemes, the list always ends with lexEOF
+func lex(s string) ([]lexeme, error) {
+	idx := (int)(0)
+	lexemes := make([]lexeme, 0)
+	for idx < len(s) {
+		if m := whitespace.FindString(s[idx:]); len(m) > 0 {
+			idx += len(m)
+			continue
+		}
+		if t, m, err := parseField(idx, s); err == nil && m > 0 {
+			lexemes = append(lexemes, lexeme{kind: lexField, text: s[idx : idx+m], token: t, pos: idx})
+			idx += m
+		} else if err != nil {
+			return nil, err
+		} else if t, m, err := parseOperator(idx, s); err == nil && m > 0 {
+			lexemes = append(lexemes, lexeme{kind: lexOperator, text: s[idx : idx+m], token: t, pos: idx})
+			idx += m
+		} else if err != nil {
+			return nil, err
+		} else if t, m, err := parseNumber(idx, s); err == nil && m > 0 {
+			lexemes = append(lexemes, lexeme{kind: lexLiteral, text: s[idx : idx+m], token: t, pos: idx})
+			idx += m
+		} else if err != nil {
+			return nil, err
+		} else if t, m, err := parseStr(idx, s); err == nil && m > 0 {
+			lexemes = append(lexemes, lexeme{kind: lexLiteral, text: s[idx : idx+m], token: t, pos: idx})
+			idx += m
+		} else if err != nil {
+			return nil, err
+		} else if s[idx] == '(' {
+			lexemes = append(lexemes, lexeme{kind: lexOpen, text: "(", pos: idx})
+			idx++
+		} else if s[idx] == ')' {
+			lexemes = append(lexemes, lexeme{kind: lexClose, text: ")", pos: idx})
+			idx++
+		} else if s[idx] == ',' {
+			lexemes = append(lexemes, lexeme{kind: lexComma, text: ",", pos: idx})
+			idx++
+		} else if m := identifier.FindString(s[idx:]); len(m) > 0 {
+			lexemes = append(lexemes, lexeme{kind: lexIdent, text: m, pos: idx})
+			idx += len(m)
+		} else {
+			return nil, parseErrorAt(s, idx, runeAt(s, idx), fmt.Sprintf("Unknown token: '%s'", runeAt(s, idx)))
+		}
+	}
+	return append(lexemes, lexeme{kind: lexEOF, pos: len(s)}), nil
+}
+
+// parseStr reads a string in either quote style, backslash escapes and a doubled quote are decoded
+func parseStr(idx int, s string) (Token, int, error) {
+	if s[idx] != '"' && s[idx] != '\'' {
+		return *(&Token{}), 0, nil
+	}
+	quote := rune(s[idx])
+	var b strings.Builder
+	oidx := idx + 1
+	for oidx < len(s) {
+		r, w := utf8.DecodeRuneInString(s[oidx:])
+		switch {
+		case r == quote && strings.HasPrefix(s[oidx+w:], string(quote)):
+			b.WriteRune(quote)
+			oidx += 2 * w
+		case r == quote:
+			return *(&Token{
+				Type:     Static,
+				Value:    b.String(),
+				Position: idx,
+			}), oidx + w - idx, nil
+		case r == '\\':
+			d, m, err := parseEscape(oidx, s)
+			if err != nil {
+				return *(&Token{}), 0, err
+			}
+			b.WriteString(d)
+			oidx += m
+		default:
+			b.WriteRune(r)
+			oidx += w
+		}
+	}
+	return *(&Token{}), 0, parseErrorAt(s, idx, s[idx:idx+1], "Unterminated string", fmt.Sprintf("%q", quote))
+}
+
+// escapes maps the character after a backslash to what it stands for
+var escapes = map[byte]string{
+	'n':  "\n",
+	't':  "\t",
+	'r':  "\r",
+	'\\': "\\",
+	'"':  "\"",
+	'\'': "'",
+}
+
+// parseEscape decodes the escape sequence starting with the backslash at idx
+func parseEscape(idx int, s string) (string, int, error) {
+	if idx+1 >= len(s) {
+		return "", 0, parseErrorAt(s, idx, s[idx:], "Unterminated escape sequence")
+	}
+	if d, ok := escapes[s[idx+1]]; ok {
+		return d, 2, nil
+	}
+	if s[idx+1] == 'u' && idx+6 <= len(s) {
+		if n, err := strconv.ParseUint(s[idx+2:idx+6], 16, 32); err == nil {
+			return string(rune(n)), 6, nil
+		}
+	}
+	seq := s[idx:idx+1] + runeAt(s, idx+1)
+	return "", 0, parseErrorAt(s, idx, seq, fmt.Sprintf("Unknown escape sequence: '%s'", seq), `\n`, `\t`, `\r`, `\\`, `\"`, `\'`, `\uXXXX`)
+}
+
+var (
+	decimalNumber = regexp.MustCompile(`^(?:[0-9](?:_?[0-9])*(?:\.(?:[0-9](?:_?[0-9])*)?)?|\.[0-9](?:_?[0-9])*)(?:[eE][+-]?[0-9]+)?%?$`)
+	hexNumber     = regexp.MustCompile(`^0[xX][0-9a-fA-F](?:_?[0-9a-fA-F])*$`)
+)
+
+// isNumberStart reports whether a number literal starts at idx, a dot only counts when a digit follows
+func isNumberStart(idx int, s string) bool {
+	if s[idx] >= '0' && s[idx] <= '9' {
+		return true
+	}
+	return s[idx] == '.' && idx+1 < len(s) && s[idx+1] >= '0' && s[idx+1] <= '9'
+}
+
+// parseNumber reads 12, 1.5, .5, 1e-3, 12% (0.12), 1_000 and 0x1F, anything else glued to a number is an error
+func parseNumber(idx int, s string) (Token, int, error) {
+	if !isNumberStart(idx, s) {
+		return *(&Token{}), 0, nil
+	}
+	oidx := idx
+	for oidx < len(s) {
+		c := s[oidx]
+		if c == '.' || c == '_' || c == '%' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			oidx++
+		} else if (c == '+' || c == '-') && (s[oidx-1] == 'e' || s[oidx-1] == 'E') && !hexNumber.MatchString(s[idx:oidx]) {
+			oidx++
+		} else {
+			break
+		}
+	}
+	text := s[idx:oidx]
+	v, ok := numberValue(text)
+	if !ok {
+		return *(&Token{}), 0, parseErrorAt(s, idx, text, fmt.Sprintf("Malformed number: '%s'", text), "a number")
+	}
+	return *(&Token{
+		Type:     Static,
+		Value:    v,
+		Position: idx,
+	}), oidx - idx, nil
+}
+
+// numberValue converts the text of a number literal, whole numbers are integers unless they do not fit
+func numberValue(text string) (interface{}, bool) {
+	clean := strings.ReplaceAll(text, "_", "")
+	if hexNumber.MatchString(text) {
+		if i, err := strconv.ParseInt(clean[2:], 16, 64); err == nil {
+			return i, true
+		}
+		if u, err := strconv.ParseUint(clean[2:], 16, 64); err == nil {
+			return float64(u), true
+		}
+		return nil, false
+	}
+	if !decimalNumber.MatchString(text) {
+		return nil, false
+	}
+	if strings.HasSuffix(clean, "%") {
+		f, err := strconv.ParseFloat(clean[:len(clean)-1], 64)
+		if err != nil {
+			return nil, false
+		}
+		return decimalValue(f / 100), true
+	}
+	if i, err := strconv.ParseInt(clean, 10, 64); err == nil {
+		return i, true
+	}
+	f, err := strconv.ParseFloat(clean, 64)
+	return f, err == nil
+}
+
+// decimalValue rounds away the binary noise of a division, 0.07 stays 0.07 instead of 0.07000000000000001
+func decimalValue(f float64) float64 {
+	v, err := strconv.ParseFloat(strconv.FormatFloat(f, 'g', 15, 64), 64)
+	if err != nil {
+		return f
+	}
+	return v
+}
+
+// ratLiteral reads the text of a number literal as an exact decimal
+func ratLiteral(text string) (*big.Rat, bool) {
+	if hexNumber.MatchString(text) {
+		v, ok := numberValue(text)
+		if !ok {
+			return nil, false
+		}
+		return toRat(v)
+	}
+	clean := strings.ReplaceAll(text, "_", "")
+	percent := strings.HasSuffix(clean, "%")
+	r, ok := new(big.Rat).SetString(strings.TrimSuffix(clean, "%"))
+	if ok && percent {
+		r.Quo(r, big.NewRat(100, 1))
+	}
+	return r, ok
+}
+
+func parseField(idx int, s string) (Token, int, error) {
+	if s[idx] != '[' {
+		return *(&Token{}), 0, nil
+	}
+	// selectors like lines[0] and attrs["a]b"] nest brackets and quotes inside the field
+	depth := 0
+	var quote byte
+	oidx := idx + 1
+	for oidx < len(s) {
+		switch c := s[oidx]; {
+		case quote != 0:
+			if c == '\\' {
+				oidx++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case c == ']':
+			path, err := parsePath(s, idx+1, oidx)
+			if err != nil {
+				return *(&Token{}), 0, err
+			}
+			return *(&Token{
+				Type:     Field,
+				Value:    (string)(s[idx+1 : oidx]),
+				Position: idx,
+				path:     &compiledPath{steps: path},
+			}), oidx - idx + 1, nil
+		}
+		oidx++
+	}
+	return *(&Token{}), idx, parseErrorAt(s, idx, s[idx:], "Unterminated field", "']'")
+}
+
+func parseOperator(idx int, s string) (Token, int, error) {
+	if idx+1 < len(s) {
+		st := s[idx : idx+2]
+		if st == "<=" || st == ">=" || st == "<>" || st == "!=" || st == "&&" || st == "||" {
+			return *(&Token{
+				Type:     Operator,
+				Value:    st,
+				Position: idx,
+			}), 2, nil
+		}
+	}
+	st := (string)(s[idx])
+	if st == "+" || st == "-" || st == "*" || st == "/" || st == "=" || st == ">" || st == "<" || st == "^" {
+		return *(&Token{
+			Type:     Operator,
+			Value:    st,
+			Position: idx,
+		}), 1, nil
+	}
+	return *(&Token{}), 0, nil
+}
@@ -0,0 +1,269 @@
+package fieldcalculator
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// truthy decides whether a value counts as true in a condition: booleans are themselves, numbers are
+// true when not zero, blanks are false and the strings "TRUE" and "FALSE" read as booleans in any case.
+// Any other string is an error.
+func truthy(v interface{}) (bool, error) {
+	switch b := v.(type) {
+	case bool:
+		return b, nil
+	case string:
+		if l, ok := boolLiterals[strings.ToUpper(b)]; ok {
+			return l, nil
+		}
+	case int64:
+		return b != 0, nil
+	case float64:
+		return b != 0, nil
+	case *big.Rat:
+		return b.Sign() != 0, nil
+	case nil:
+		return false, nil
+	}
+	return false, errors.New(fmt.Sprintf("Value '%v' is not a boolean", v))
+}
+
+// truthyArg is truthy for the argument at idx of the running function
+func truthyArg(idx int, v interface{}) (bool, error) {
+	b, err := truthy(v)
+	if err != nil {
+		return false, argError(idx, v, err.Error())
+	}
+	return b, nil
+}
+
+// allTruthy reports whether every value in argument idx is true, stopping at the first false one
+func allTruthy(idx int, t Token) (bool, error) {
+	for _, x := range flattenTokens([]Token{t}) {
+		b, err := truthyArg(idx, x.Value)
+		if err != nil || !b {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// anyTruthy reports whether a value in argument idx is true, stopping at the first true one
+func anyTruthy(idx int, t Token) (bool, error) {
+	for _, x := range flattenTokens([]Token{t}) {
+		b, err := truthyArg(idx, x.Value)
+		if err != nil || b {
+			return b, err
+		}
+	}
+	return false, nil
+}
+
+func fnAnd(ths []Thunk) (Token, error) {
+	for i, th := range ths {
+		t, err := th()
+		if err != nil {
+			return *(&Token{}), err
+		}
+		if b, err := allTruthy(i, t); err != nil {
+			return *(&Token{}), err
+		} else if !b {
+			return staticToken(false), nil
+		}
+	}
+	return staticToken(true), nil
+}
+
+func fnOr(ths []Thunk) (Token, error) {
+	for i, th := range ths {
+		t, err := th()
+		if err != nil {
+			return *(&Token{}), err
+		}
+		if b, err := anyTruthy(i, t); err != nil {
+			return *(&Token{}), err
+		} else if b {
+			return staticToken(true), nil
+		}
+	}
+	return staticToken(false), nil
+}
+
+func fnNot(ts []Token) (Token, error) {
+	return mapTokens(ts[0], func(a interface{}) (interface{}, error) {
+		b, err := truthyArg(0, a)
+		return !b, err
+	})
+}
+
+// logical builds && and ||, a single left value that decides the result skips the right side,
+// lists are combined per element
+func logical(and bool) func([]Thunk) (Token, error) {
+	return func(ths []Thunk) (Token, error) {
+		l, err := ths[0]()
+		if err != nil {
+			return *(&Token{}), err
+		}
+		if l.Type != Scope {
+			b, err := truthyArg(0, l.Value)
+			if err != nil {
+				return *(&Token{}), err
+			}
+			if b != and {
+				return staticToken(b), nil
+			}
+			r, err := ths[1]()
+			if err != nil {
+				return *(&Token{}), err
+			}
+			return mapTokens(r, func(a interface{}) (interface{}, error) {
+				return truthyArg(1, a)
+			})
+		}
+		r, err := ths[1]()
+		if err != nil {
+			return *(&Token{}), err
+		}
+		return elementwise(l, r, func(a, b interface{}) (interface{}, error) {
+			ab, err := truthyArg(0, a)
+			if err != nil {
+				return nil, err
+			}
+			bb, err := truthyArg(1, b)
+			if err != nil {
+				return nil, err
+			}
+			if and {
+				return ab && bb, nil
+			}
+			return ab || bb, nil
+		})
+	}
+}
+
+var (
+	opAnd = logical(true)
+	opOr  = logical(false)
+)
+
+// fnIf only evaluates the branch it takes, a list condition evaluates each branch some element selects
+func fnIf(ths []Thunk) (Token, error) {
+	c, err := ths[0]()
+	if err != nil {
+		return *(&Token{}), err
+	}
+	otherwise := func() (Token, error) {
+		if len(ths) > 2 {
+			return ths[2]()
+		}
+		return staticToken(false), nil
+	}
+	if c.Type != Scope {
+		b, err := truthyArg(0, c.Value)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		if b {
+			return ths[1]()
+		}
+		return otherwise()
+	}
+	conds := flattenTokens([]Token{c})
+	picks := make([]bool, len(conds))
+	anyTrue, anyFalse := false, false
+	for i, ct := range conds {
+		if picks[i], err = truthyArg(0, ct.Value); err != nil {
+			return *(&Token{}), err
+		}
+		anyTrue, anyFalse = anyTrue || picks[i], anyFalse || !picks[i]
+	}
+	// a branch no condition selects is never evaluated
+	branch := func(selected bool, th Thunk) ([]Token, error) {
+		if !selected {
+			return nil, nil
+		}
+		t, err := th()
+		if err != nil {
+			return nil, err
+		}
+		ts := flattenTokens([]Token{t})
+		if len(ts) != 1 && len(ts) != len(conds) {
+			return nil, errors.New(fmt.Sprintf("IF branches do not match the %d conditions", len(conds)))
+		}
+		return ts, nil
+	}
+	as, err := branch(anyTrue, ths[1])
+	if err != nil {
+		return *(&Token{}), err
+	}
+	bs, err := branch(anyFalse, otherwise)
+	if err != nil {
+		return *(&Token{}), err
+	}
+	var rts []Token = make([]Token, 0, len(conds))
+	for i := range conds {
+		pick := bs
+		if picks[i] {
+			pick = as
+		}
+		if len(pick) == 1 {
+			rts = append(rts, pick[0])
+		} else {
+			rts = append(rts, pick[i])
+		}
+	}
+	return listToken(rts), nil
+}
+
+// fnIfs returns the value paired with the first true condition
+func fnIfs(ths []Thunk) (Token, error) {
+	if len(ths)%2 != 0 {
+		return *(&Token{}), errors.New("Expects pairs of condition and value")
+	}
+	for i := 0; i < len(ths); i += 2 {
+		c, err := ths[i]()
+		if err != nil {
+			return *(&Token{}), err
+		}
+		if c.Type == Scope {
+			return *(&Token{}), argError(i, c.Value, "IFS conditions must be a single value")
+		}
+		b, err := truthyArg(i, c.Value)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		if b {
+			return ths[i+1]()
+		}
+	}
+	return *(&Token{}), errors.New("No condition is true")
+}
+
+// predicate builds the IS functions testing each value
+func predicate(test func(interface{}) bool) func([]Token) (Token, error) {
+	return func(ts []Token) (Token, error) {
+		return mapTokens(ts[0], func(a interface{}) (interface{}, error) {
+			return test(a), nil
+		})
+	}
+}
+
+var (
+	fnIsBlank  = predicate(func(v interface{}) bool { return v == nil })
+	fnIsNumber = predicate(isNumber)
+	fnIsText   = predicate(func(v interface{}) bool {
+		_, ok := v.(string)
+		return ok
+	})
+	fnIsLogical = predicate(func(v interface{}) bool {
+		_, ok := v.(bool)
+		return ok
+	})
+)
+
+// fnNull is the blank value, NULL() and BLANK() are the same
+func fnNull(ts []Token) (Token, error) {
+	return staticToken(nil), nil
+}
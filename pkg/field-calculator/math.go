@@ -0,0 +1,219 @@
+package fieldcalculator
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// fromRat converts an exact result back to the kind of its operands: decimals stay decimals,
+// integers stay integers when the result is whole and fits, anything else becomes a float64
+func fromRat(r *big.Rat, like ...interface{}) interface{} {
+	ints := true
+	for _, v := range like {
+		switch v.(type) {
+		case *big.Rat:
+			return r
+		case int64:
+		default:
+			ints = false
+		}
+	}
+	if ints && r.IsInt() && r.Num().IsInt64() {
+		return r.Num().Int64()
+	}
+	f, _ := r.Float64()
+	return f
+}
+
+// roundNumber rounds v to places decimal places, keeping its kind
+func roundNumber(v interface{}, places int, mode RoundingMode) interface{} {
+	if _, ok := v.(int64); ok && places >= 0 {
+		return v
+	}
+	r, ok := toRat(v)
+	if !ok {
+		return v
+	}
+	return fromRat(roundRat(r, places, mode), v)
+}
+
+// mathArg checks argument idx of fn is a number
+func mathArg(fn string, idx int, v interface{}) error {
+	if !isNumber(v) {
+		return argError(idx, v, fmt.Sprintf("Field for %s is not a number", fn))
+	}
+	return nil
+}
+
+// unaryMath builds an element-wise function of one number
+func unaryMath(fn string, f func(interface{}) (interface{}, error)) func([]Token) (Token, error) {
+	return func(ts []Token) (Token, error) {
+		return mapTokens(ts[0], func(a interface{}) (interface{}, error) {
+			a = blankAs(a, nil)
+			if err := mathArg(fn, 0, a); err != nil {
+				return nil, err
+			}
+			return f(a)
+		})
+	}
+}
+
+// binaryMath builds an element-wise function of two numbers, a missing second argument is def
+func binaryMath(fn string, def interface{}, f func(a, b interface{}) (interface{}, error)) func([]Token) (Token, error) {
+	return func(ts []Token) (Token, error) {
+		b := staticToken(def)
+		if len(ts) > 1 {
+			b = ts[1]
+		}
+		return elementwise(ts[0], b, func(a, b interface{}) (interface{}, error) {
+			a, b = blanksAsNumbers(a, b)
+			if err := mathArg(fn, 0, a); err != nil {
+				return nil, err
+			}
+			if err := mathArg(fn, 1, b); err != nil {
+				return nil, err
+			}
+			return f(a, b)
+		})
+	}
+}
+
+// rounder builds ROUND and friends, the optional second argument is the number of digits
+func rounder(fn string, mode RoundingMode) func([]Token) (Token, error) {
+	return binaryMath(fn, int64(0), func(a, b interface{}) (interface{}, error) {
+		digits, ok := ToInt64(b)
+		if !ok || digits > 1000 || digits < -1000 {
+			return nil, argError(1, b, fmt.Sprintf("%s digits must be a whole number", fn))
+		}
+		return roundNumber(a, int(digits), mode), nil
+	})
+}
+
+var (
+	fnRound     = rounder("ROUND", RoundHalfUp)
+	fnRoundUp   = rounder("ROUNDUP", RoundUp)
+	fnRoundDown = rounder("ROUNDDOWN", RoundDown)
+	fnTrunc     = rounder("TRUNC", RoundDown)
+)
+
+// multiple builds FLOOR and CEILING, rounding to a multiple of the significance
+func multiple(fn string, mode RoundingMode) func([]Token) (Token, error) {
+	return binaryMath(fn, int64(1), func(a, b interface{}) (interface{}, error) {
+		if isZero(b) {
+			return fromRat(new(big.Rat), a, b), nil
+		}
+		ar, _ := toRat(a)
+		br, _ := toRat(b)
+		if ar.Sign() > 0 && br.Sign() < 0 {
+			return nil, argError(1, b, fmt.Sprintf("%s significance must not be negative for a positive number", fn))
+		}
+		br = new(big.Rat).Abs(br)
+		q := roundRat(new(big.Rat).Quo(ar, br), 0, mode)
+		return fromRat(q.Mul(q, br), a, b), nil
+	})
+}
+
+var (
+	fnFloor   = multiple("FLOOR", RoundFloor)
+	fnCeiling = multiple("CEILING", RoundCeiling)
+)
+
+var fnAbs = unaryMath("ABS", func(a interface{}) (interface{}, error) {
+	if compareNumbers(a, int64(0)) < 0 {
+		return negateNumber(a), nil
+	}
+	return a, nil
+})
+
+var fnSign = unaryMath("SIGN", func(a interface{}) (interface{}, error) {
+	return int64(compareNumbers(a, int64(0))), nil
+})
+
+// fnMod takes the sign of the divisor like spreadsheets do, MOD(-3, 2) is 1
+var fnMod = binaryMath("MOD", nil, func(a, b interface{}) (interface{}, error) {
+	if isZero(b) {
+		return nil, argError(1, b, "Division by zero")
+	}
+	ar, _ := toRat(a)
+	br, _ := toRat(b)
+	q := roundRat(new(big.Rat).Quo(ar, br), 0, RoundFloor)
+	return fromRat(q.Sub(ar, q.Mul(q, br)), a, b), nil
+})
+
+// maxExactExponent keeps exact powers from building huge numbers, larger exponents use floats
+const maxExactExponent = 1024
+
+// maxFloat bounds exact powers like the float path is bounded, a larger result could not be a float64
+var maxFloat = new(big.Rat).SetFloat64(math.MaxFloat64)
+
+func power(a, b interface{}) (interface{}, error) {
+	if isZero(a) && compareNumbers(b, int64(0)) < 0 {
+		return nil, argError(1, b, "Zero cannot be raised to a negative power")
+	}
+	_, isFloat := a.(float64)
+	if e, ok := ToInt64(b); ok && !isFloat && e <= maxExactExponent && e >= -maxExactExponent {
+		ar, _ := toRat(a)
+		n := big.NewInt(e)
+		if e < 0 {
+			n.Neg(n)
+		}
+		r := new(big.Rat).SetFrac(new(big.Int).Exp(ar.Num(), n, nil), new(big.Int).Exp(ar.Denom(), n, nil))
+		if e < 0 {
+			r.Inv(r)
+		}
+		if new(big.Rat).Abs(r).Cmp(maxFloat) > 0 {
+			return nil, argError(1, b, "Power is too large")
+		}
+		return fromRat(r, a, b), nil
+	}
+	af, _ := ToFloat64(a)
+	bf, _ := ToFloat64(b)
+	f := math.Pow(af, bf)
+	if math.IsNaN(f) {
+		return nil, argError(0, a, "A negative number cannot be raised to a fractional power")
+	}
+	if math.IsInf(f, 0) {
+		return nil, argError(1, b, "Power is too large")
+	}
+	return f, nil
+}
+
+var (
+	fnPower = binaryMath("POWER", nil, power)
+	opPower = binaryMath("^", nil, power)
+)
+
+// floatMath builds functions computed in float64, domain rejects arguments outside the domain with a message
+func floatMath(fn string, f func(float64) float64, domain func(float64) string) func([]Token) (Token, error) {
+	return unaryMath(fn, func(a interface{}) (interface{}, error) {
+		af, _ := ToFloat64(a)
+		if msg := domain(af); msg != "" {
+			return nil, argError(0, a, fmt.Sprintf("%s of %s", fn, msg))
+		}
+		r := f(af)
+		if math.IsInf(r, 0) {
+			return nil, argError(0, a, fmt.Sprintf("%s result is too large", fn))
+		}
+		return r, nil
+	})
+}
+
+func positive(f float64) string {
+	if f <= 0 {
+		return "a number that is not positive"
+	}
+	return ""
+}
+
+var (
+	fnSqrt = floatMath("SQRT", math.Sqrt, func(f float64) string {
+		if f < 0 {
+			return "a negative number"
+		}
+		return ""
+	})
+	fnExp   = floatMath("EXP", math.Exp, func(float64) string { return "" })
+	fnLn    = floatMath("LN", math.Log, positive)
+	fnLog10 = floatMath("LOG10", math.Log10, positive)
+)
@@ -0,0 +1,251 @@
+package fieldcalculator
+
+import (
+	"encoding/json"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+)
+
+// Numbers inside the calculator are int64 or float64, or *big.Rat in exact decimal mode. Integer
+// arithmetic stays int64 as long as the result is exact and fits, anything else falls back to float64.
+// Once one side is a *big.Rat the operation is done exactly.
+
+// decimalFloat is implemented by decimal types reporting whether the conversion was exact
+type decimalFloat interface {
+	Float64() (float64, bool)
+}
+
+// coerceNumber normalizes the numeric kinds a field can hold to int64 or float64,
+// values that are not numbers are returned untouched
+func coerceNumber(v interface{}) interface{} {
+	switch n := v.(type) {
+	case nil, int64, float64, bool, string:
+		return v
+	case float32:
+		return float32ToFloat64(n)
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i
+		}
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+		return v
+	case *big.Int:
+		if n == nil {
+			return nil
+		}
+		if n.IsInt64() {
+			return n.Int64()
+		}
+		f, _ := new(big.Float).SetInt(n).Float64()
+		return f
+	case *big.Rat:
+		if n == nil {
+			return nil
+		}
+		if n.IsInt() && n.Num().IsInt64() {
+			return n.Num().Int64()
+		}
+		f, _ := n.Float64()
+		return f
+	case *big.Float:
+		if n == nil {
+			return nil
+		}
+		if i, acc := n.Int64(); acc == big.Exact {
+			return i
+		}
+		f, _ := n.Float64()
+		return f
+	case decimalFloat:
+		f, _ := n.Float64()
+		return f
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if u := rv.Uint(); u <= math.MaxInt64 {
+			return int64(u)
+		}
+		return float64(rv.Uint())
+	case reflect.Float32:
+		return float32ToFloat64(float32(rv.Float()))
+	case reflect.Float64:
+		return rv.Float()
+	}
+	return v
+}
+
+// float32ToFloat64 keeps the decimal digits a float32 prints with, 0.1 stays 0.1 instead of 0.10000000149
+func float32ToFloat64(f float32) float64 {
+	v, err := strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+	if err != nil {
+		return float64(f)
+	}
+	return v
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int64, float64:
+		return true
+	case *big.Rat:
+		return v.(*big.Rat) != nil
+	}
+	return false
+}
+
+// ToFloat64 reads any numeric value as a float64, for use in custom functions
+func ToFloat64(v interface{}) (float64, bool) {
+	switch n := coerceNumber(v).(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// ToInt64 reads a numeric value holding a whole number as an int64, for use in custom functions
+func ToInt64(v interface{}) (int64, bool) {
+	switch n := coerceNumber(v).(type) {
+	case int64:
+		return n, true
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+// bothInts returns a and b as int64 when neither is a float
+func bothInts(a, b interface{}) (int64, int64, bool) {
+	ai, aok := a.(int64)
+	bi, bok := b.(int64)
+	return ai, bi, aok && bok
+}
+
+func addNumbers(a, b interface{}) interface{} {
+	if ar, br, ok := bothRats(a, b); ok {
+		return new(big.Rat).Add(ar, br)
+	}
+	if ai, bi, ok := bothInts(a, b); ok {
+		if s := ai + bi; (bi >= 0) == (s >= ai) {
+			return s
+		}
+	}
+	af, _ := ToFloat64(a)
+	bf, _ := ToFloat64(b)
+	return af + bf
+}
+
+func subtractNumbers(a, b interface{}) interface{} {
+	if ar, br, ok := bothRats(a, b); ok {
+		return new(big.Rat).Sub(ar, br)
+	}
+	if ai, bi, ok := bothInts(a, b); ok {
+		if s := ai - bi; (bi >= 0) == (s <= ai) {
+			return s
+		}
+	}
+	af, _ := ToFloat64(a)
+	bf, _ := ToFloat64(b)
+	return af - bf
+}
+
+func multiplyNumbers(a, b interface{}) interface{} {
+	if ar, br, ok := bothRats(a, b); ok {
+		return new(big.Rat).Mul(ar, br)
+	}
+	if ai, bi, ok := bothInts(a, b); ok {
+		if ai == 0 || bi == 0 {
+			return int64(0)
+		}
+		if s := ai * bi; s/bi == ai && !(ai == -1 && bi == math.MinInt64) && !(bi == -1 && ai == math.MinInt64) {
+			return s
+		}
+	}
+	af, _ := ToFloat64(a)
+	bf, _ := ToFloat64(b)
+	return af * bf
+}
+
+// divideNumbers expects b to be non zero
+func divideNumbers(a, b interface{}) interface{} {
+	if ar, br, ok := bothRats(a, b); ok {
+		return new(big.Rat).Quo(ar, br)
+	}
+	if ai, bi, ok := bothInts(a, b); ok && ai%bi == 0 && !(ai == math.MinInt64 && bi == -1) {
+		return ai / bi
+	}
+	af, _ := ToFloat64(a)
+	bf, _ := ToFloat64(b)
+	return af / bf
+}
+
+func negateNumber(a interface{}) interface{} {
+	if ar, ok := a.(*big.Rat); ok {
+		return new(big.Rat).Neg(ar)
+	}
+	if ai, ok := a.(int64); ok && ai != math.MinInt64 {
+		return -ai
+	}
+	af, _ := ToFloat64(a)
+	return -af
+}
+
+func isZero(v interface{}) bool {
+	if r, ok := v.(*big.Rat); ok {
+		return r.Sign() == 0
+	}
+	f, ok := ToFloat64(v)
+	return ok && f == 0
+}
+
+// floatTolerance is how far apart, relative to their magnitude, two floats may be and still be equal
+const floatTolerance = 1e-12
+
+// equalNumbers tests two numbers for equality, floats within floatTolerance so 0.1 + 0.2 equals 0.3
+func equalNumbers(a, b interface{}) bool {
+	if compareNumbers(a, b) == 0 {
+		return true
+	}
+	if _, _, ok := bothRats(a, b); ok {
+		return false
+	}
+	if _, _, ok := bothInts(a, b); ok {
+		return false
+	}
+	af, _ := ToFloat64(a)
+	bf, _ := ToFloat64(b)
+	return math.Abs(af-bf) <= floatTolerance*math.Max(math.Abs(af), math.Abs(bf))
+}
+
+// compareNumbers orders two numbers exactly, equality of floats is equalNumbers
+func compareNumbers(a, b interface{}) int {
+	if ar, br, ok := bothRats(a, b); ok {
+		return ar.Cmp(br)
+	}
+	if ai, bi, ok := bothInts(a, b); ok {
+		if ai == bi {
+			return 0
+		} else if ai < bi {
+			return -1
+		}
+		return 1
+	}
+	af, _ := ToFloat64(a)
+	bf, _ := ToFloat64(b)
+	if af == bf {
+		return 0
+	} else if af < bf {
+		return -1
+	}
+	return 1
+}
@@ -0,0 +1,208 @@
+package fieldcalculator
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// operandExpected lists what can start an operand
+var operandExpected = []string{"a number", "a string", "a boolean", "a [field]", "a function", "'('", "'-'"}
+
+var boolLiterals = map[string]bool{
+	"TRUE":  true,
+	"FALSE": false,
+}
+
+// parser is a precedence climbing parser over the lexemes of one formula
+type parser struct {
+	src     string
+	lexemes []lexeme
+	idx     int
+	env     *Env
+	fields  []Token
+	exact   bool
+}
+
+func (ev *Evaluator) tokenize(s string) error {
+	lexemes, err := lex(s)
+	if err != nil {
+		return err
+	}
+	p := &parser{
+		src:     s,
+		lexemes: lexemes,
+		env:     ev.environment(),
+		fields:  make([]Token, 0),
+		exact:   ev.exact,
+	}
+	t, err := p.expression(math.MinInt32)
+	if err != nil {
+		return err
+	}
+	if l := p.peek(); l.kind != lexEOF {
+		return parseErrorAt(s, l.pos, l.text, fmt.Sprintf("Unexpected %s", tokenText(l)), "an operator", "end of formula")
+	}
+	if err := ev.known([]Token{t}, s); err != nil {
+		return err
+	}
+	if err := ev.validate([]Token{t}, s); err != nil {
+		return err
+	}
+	ev.Tokens = []Token{t}
+	ev.fields = p.fields
+	return nil
+}
+
+func (p *parser) peek() lexeme {
+	return p.lexemes[p.idx]
+}
+
+func (p *parser) next() lexeme {
+	l := p.lexemes[p.idx]
+	if l.kind != lexEOF {
+		p.idx++
+	}
+	return l
+}
+
+// expression parses operands joined by binary operators binding at least as tight as minPrec
+func (p *parser) expression(minPrec int) (Token, error) {
+	left, err := p.operand()
+	if err != nil {
+		return *(&Token{}), err
+	}
+	for {
+		l := p.peek()
+		if l.kind != lexOperator {
+			return left, nil
+		}
+		op := l.token.Value.(string)
+		prec, ok := operatorPrecedence[op]
+		if !ok || prec < minPrec {
+			return left, nil
+		}
+		p.next()
+		nextPrec := prec + 1
+		if rightAssociative[op] {
+			nextPrec = prec
+		}
+		right, err := p.expression(nextPrec)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		left = *(&Token{
+			Type:     FuncScope,
+			Value:    []Token{l.token, left, right},
+			Position: l.pos,
+		})
+	}
+}
+
+// operand parses a literal, field, group, function call or prefix negation
+func (p *parser) operand() (Token, error) {
+	l := p.next()
+	switch l.kind {
+	case lexLiteral:
+		if p.exact && isNumber(l.token.Value) {
+			// read the source text so literals are exact even past float64 precision
+			if r, ok := ratLiteral(l.text); ok {
+				l.token.Value = r
+			}
+		}
+		return l.token, nil
+	case lexField:
+		p.fields = append(p.fields, l.token)
+		return l.token, nil
+	case lexOperator:
+		if l.text != "-" {
+			break
+		}
+		// a minus written right against a number is part of the literal
+		if n := p.peek(); n.kind == lexLiteral && n.pos == l.pos+1 && isNumber(n.token.Value) {
+			p.next()
+			v := negateNumber(n.token.Value)
+			if p.exact {
+				if r, ok := ratLiteral(n.text); ok {
+					v = r.Neg(r)
+				}
+			}
+			return *(&Token{
+				Type:     Static,
+				Value:    v,
+				Position: l.pos,
+			}), nil
+		}
+		t, err := p.expression(prefixPrecedence)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		return *(&Token{
+			Type:     FuncScope,
+			Value:    []Token{l.token, t},
+			Position: l.pos,
+		}), nil
+	case lexOpen:
+		t, err := p.expression(math.MinInt32)
+		if err != nil {
+			return *(&Token{}), err
+		}
+		if c := p.next(); c.kind != lexClose {
+			return *(&Token{}), parseErrorAt(p.src, c.pos, c.text, fmt.Sprintf("Unclosed '(', got %s", tokenText(c)), "')'")
+		}
+		return *(&Token{
+			Type:     Scope,
+			Value:    []Token{t},
+			Position: l.pos,
+		}), nil
+	case lexIdent:
+		// TRUE and FALSE are literals unless called like a function
+		if b, ok := boolLiterals[strings.ToUpper(l.text)]; ok && p.peek().kind != lexOpen {
+			return *(&Token{
+				Type:     Static,
+				Value:    b,
+				Position: l.pos,
+			}), nil
+		}
+		return p.call(l)
+	}
+	return *(&Token{}), parseErrorAt(p.src, l.pos, l.text, fmt.Sprintf("Unexpected %s", tokenText(l)), operandExpected...)
+}
+
+// call parses the argument list of function name
+func (p *parser) call(name lexeme) (Token, error) {
+	if _, ok := p.env.Lookup(name.text); !ok {
+		return *(&Token{}), parseErrorAt(p.src, name.pos, name.text, fmt.Sprintf("Unknown function or token: '%s'", name.text))
+	}
+	if o := p.next(); o.kind != lexOpen {
+		return *(&Token{}), parseErrorAt(p.src, o.pos, o.text, fmt.Sprintf("Function %s is not called, got %s", name.text, tokenText(o)), "'('")
+	}
+	ts := []Token{*(&Token{
+		Type:     Function,
+		Value:    name.text,
+		Position: name.pos,
+	})}
+	if p.peek().kind == lexClose {
+		p.next()
+	} else {
+		for {
+			t, err := p.expression(math.MinInt32)
+			if err != nil {
+				return *(&Token{}), err
+			}
+			ts = append(ts, t)
+			l := p.next()
+			if l.kind == lexClose {
+				break
+			}
+			if l.kind != lexComma {
+				return *(&Token{}), parseErrorAt(p.src, l.pos, l.text, fmt.Sprintf("Unexpected %s in arguments of %s", tokenText(l), name.text), "','", "')'")
+			}
+		}
+	}
+	return *(&Token{
+		Type:     FuncScope,
+		Value:    ts,
+		Position: name.pos,
+	}), nil
+}
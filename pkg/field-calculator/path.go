@@ -0,0 +1,171 @@
+package fieldcalculator
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Field paths are names separated by dots, every name may be followed by selectors in brackets:
+//   lines[0].price     the first line, negative indexes count from the end
+//   lines[1:3].price   lines 1 and 2, either bound may be left out
+//   lines[*].price     every line, the same as lines.price; on a map every value ordered by key
+//   attrs["color"]     the entry or field called color, quoted names may hold dots and brackets
+
+type stepKind int
+
+const (
+	stepName stepKind = iota
+	stepIndex
+	stepSlice
+	stepAll
+)
+
+// pathStep is one step of a field path
+type pathStep struct {
+	kind stepKind
+	name string
+	// index is the element of stepIndex, from and to bound stepSlice when set
+	index    int
+	from, to *int
+}
+
+type fieldPath []pathStep
+
+// compiledPath is the parsed path of a Field token, plans caches it compiled per record type
+type compiledPath struct {
+	steps fieldPath
+	plans sync.Map
+}
+
+// fieldPathOf is the path of a Field token, parsed when the token was made by the parser or loaded
+func fieldPathOf(t Token) (*compiledPath, error) {
+	if t.path != nil {
+		return t.path, nil
+	}
+	s := t.Value.(string)
+	path, err := parsePath(s, 0, len(s))
+	if err != nil {
+		return nil, err
+	}
+	return &compiledPath{steps: path}, nil
+}
+
+// parsePath parses the field path in s[start:end], errors point into s
+func parsePath(s string, start, end int) (fieldPath, error) {
+	path := make(fieldPath, 0)
+	idx := start
+	for {
+		nidx := idx
+		for nidx < end && s[nidx] != '.' && s[nidx] != '[' && s[nidx] != ']' {
+			nidx++
+		}
+		if nidx > idx {
+			path = append(path, pathStep{kind: stepName, name: s[idx:nidx]})
+		} else if nidx == end || s[nidx] != '[' {
+			return nil, parseErrorAt(s, idx, s[idx:end], "Malformed field path", "a field name")
+		}
+		idx = nidx
+		for idx < end && s[idx] == '[' {
+			step, m, err := parseSelector(s, idx, end)
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, step)
+			idx += m
+		}
+		if idx == end {
+			return path, nil
+		}
+		if s[idx] != '.' {
+			return nil, parseErrorAt(s, idx, s[idx:end], "Malformed field path", "'.'", "'['")
+		}
+		idx++
+	}
+}
+
+// parseSelector parses the bracketed selector at idx and returns how much of s it took
+func parseSelector(s string, idx, end int) (pathStep, int, error) {
+	oidx := idx + 1
+	if oidx < end && (s[oidx] == '"' || s[oidx] == '\'') {
+		t, m, err := parseStr(oidx, s[:end])
+		if err != nil {
+			return pathStep{}, 0, err
+		}
+		if oidx+m >= end || s[oidx+m] != ']' {
+			return pathStep{}, 0, parseErrorAt(s, oidx+m, s[oidx+m:end], "Malformed field path", "']'")
+		}
+		return pathStep{kind: stepName, name: t.Value.(string)}, oidx + m + 1 - idx, nil
+	}
+	for oidx < end && s[oidx] != ']' {
+		oidx++
+	}
+	if oidx == end {
+		return pathStep{}, 0, parseErrorAt(s, idx, s[idx:end], "Malformed field path", "']'")
+	}
+	sel := strings.TrimSpace(s[idx+1 : oidx])
+	bad := parseErrorAt(s, idx+1, s[idx+1:oidx], "Malformed field index", "a number", "a slice", "'*'", "a quoted name")
+	step := pathStep{kind: stepAll}
+	if i := strings.Index(sel, ":"); i >= 0 {
+		step.kind = stepSlice
+		var ok bool
+		if step.from, ok = boundOf(sel[:i]); !ok {
+			return pathStep{}, 0, bad
+		}
+		if step.to, ok = boundOf(sel[i+1:]); !ok {
+			return pathStep{}, 0, bad
+		}
+	} else if sel != "*" {
+		n, err := strconv.Atoi(sel)
+		if err != nil {
+			return pathStep{}, 0, bad
+		}
+		step.kind, step.index = stepIndex, n
+	}
+	return step, oidx + 1 - idx, nil
+}
+
+// boundOf reads a slice bound, nil when it was left out
+func boundOf(s string) (*int, bool) {
+	if s = strings.TrimSpace(s); s == "" {
+		return nil, true
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, false
+	}
+	return &n, true
+}
+
+// bounds clamps the slice of step to a list of n elements
+func (step pathStep) bounds(n int) (int, int) {
+	clamp := func(b *int, def int) int {
+		if b == nil {
+			return def
+		}
+		i := *b
+		if i < 0 {
+			i += n
+		}
+		if i < 0 {
+			return 0
+		} else if i > n {
+			return n
+		}
+		return i
+	}
+	from, to := clamp(step.from, 0), clamp(step.to, n)
+	if to < from {
+		to = from
+	}
+	return from, to
+}
+
+// element is the position of the stepIndex element in a list of n elements
+func (step pathStep) element(n int) (int, bool) {
+	i := step.index
+	if i < 0 {
+		i += n
+	}
+	return i, i >= 0 && i < n
+}
@@ -0,0 +1,567 @@
+package fieldcalculator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Missing values: a nil pointer, nil interface or nil slice on the way to a field resolves to a blank
+// (nil) value, or to an empty list when the path goes through a slice. Only a path that does not exist
+// on the type is an error, unless the evaluator is strict.
+//
+// Maps with string keys are traversed like structs so decoded JSON works as a record, a key missing from
+// a map is blank since such data has no schema to check against. json.RawMessage is decoded on the way.
+//
+// Struct fields are named by their tag (calc by default, see WithTagKey) or their Go name, fields of
+// embedded structs are promoted like in Go and unexported fields are never visible.
+//
+// With WithMethods a name that is not a field may call an exported method taking no arguments and
+// returning a value, or a value and an error which then fails the evaluation.
+
+var (
+	errFieldMissing = errors.New("Field is unresolveable")
+	errFieldBlank   = errors.New("Field is blank")
+	errFieldJSON    = errors.New("Field is not valid JSON")
+)
+
+var (
+	rawMessageType = reflect.TypeOf(json.RawMessage(nil))
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// methodError is an error returned or raised by a method called from a field path
+type methodError struct {
+	method string
+	err    error
+}
+
+func (e *methodError) Error() string {
+	return fmt.Sprintf("Method %s failed: %v", e.method, e.err)
+}
+
+func (e *methodError) Unwrap() error {
+	return e.err
+}
+
+// hideTag is the default tag key naming fields, its "-" hides a field whatever tag key names fields
+const hideTag = "calc"
+
+// resolver finds the values a field path refers to in a record, the zero value names fields by calc tags
+type resolver struct {
+	// tag is the tag key naming fields, empty for calc
+	tag           string
+	caseSensitive bool
+	strict        bool
+	methods       bool
+}
+
+// WithStrictFields makes a nil pointer or nil slice on the way to a field an error instead of a blank
+func WithStrictFields() ParserOption {
+	return func(ev *Evaluator) {
+		ev.resolver.strict = true
+	}
+}
+
+// WithTagKey names struct fields by the tag key instead of calc, WithTagKey("json") matches API names
+func WithTagKey(key string) ParserOption {
+	return func(ev *Evaluator) {
+		ev.resolver.tag = key
+	}
+}
+
+// WithCaseSensitiveFields matches field names and map keys exactly instead of ignoring case
+func WithCaseSensitiveFields() ParserOption {
+	return func(ev *Evaluator) {
+		ev.resolver.caseSensitive = true
+	}
+}
+
+// WithMethods lets field paths call exported methods without arguments, methods run arbitrary code so
+// this is opt-in
+func WithMethods() ParserOption {
+	return func(ev *Evaluator) {
+		ev.resolver.methods = true
+	}
+}
+
+func (r resolver) matches(name, want string) bool {
+	if r.caseSensitive {
+		return name == want
+	}
+	return strings.EqualFold(name, want)
+}
+
+// fieldName is the name f goes by, tagged reports whether it came from a tag
+func (r resolver) fieldName(f reflect.StructField) (name string, tagged, hidden bool) {
+	if f.Tag.Get(hideTag) == "-" {
+		return "", false, true
+	}
+	key := r.tag
+	if key == "" {
+		key = hideTag
+	}
+	tag := f.Tag.Get(key)
+	if tag == "-" {
+		return "", false, true
+	}
+	if i := strings.Index(tag, ","); i >= 0 {
+		tag = tag[:i]
+	}
+	if tag != "" {
+		return tag, true, false
+	}
+	return f.Name, false, false
+}
+
+// field finds the index of the struct field called name. Fields of embedded structs are promoted like Go
+// does it: the shallowest one wins and two at the same depth hide each other.
+func (r resolver) field(t reflect.Type, name string) ([]int, bool) {
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+	current := []embedded{{t: t}}
+	seen := map[reflect.Type]bool{}
+	for len(current) > 0 {
+		var found []int
+		count := 0
+		next := make([]embedded, 0)
+		for _, e := range current {
+			if seen[e.t] {
+				continue
+			}
+			seen[e.t] = true
+			for i := 0; i < e.t.NumField(); i++ {
+				f := e.t.Field(i)
+				fname, tagged, hidden := r.fieldName(f)
+				if hidden {
+					continue
+				}
+				index := append(append(make([]int, 0, len(e.index)+1), e.index...), i)
+				if f.Anonymous && !tagged {
+					ft := f.Type
+					if ft.Kind() == reflect.Ptr {
+						ft = ft.Elem()
+					}
+					if ft.Kind() == reflect.Struct {
+						next = append(next, embedded{ft, index})
+					}
+				}
+				if f.PkgPath == "" && r.matches(fname, name) {
+					found, count = index, count+1
+				}
+			}
+		}
+		if count == 1 {
+			return found, true
+		} else if count > 1 {
+			return nil, false
+		}
+		current = next
+	}
+	return nil, false
+}
+
+// fieldByIndex is v.FieldByIndex that reports a nil embedded pointer instead of panicking
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for j, i := range index {
+		if j > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v, true
+}
+
+// method finds the method called name in the method set of *t, which holds the value receiver methods too
+func (r resolver) method(t reflect.Type, name string) (reflect.Method, bool) {
+	if !r.methods {
+		return reflect.Method{}, false
+	}
+	pt := reflect.PtrTo(t)
+	for i := 0; i < pt.NumMethod(); i++ {
+		m := pt.Method(i)
+		if !r.matches(m.Name, name) {
+			continue
+		}
+		// m.Type has the receiver as its first argument
+		switch mt := m.Type; {
+		case mt.NumIn() != 1:
+		case mt.NumOut() == 1:
+			return m, true
+		case mt.NumOut() == 2 && mt.Out(1) == errorType:
+			return m, true
+		}
+		return reflect.Method{}, false
+	}
+	return reflect.Method{}, false
+}
+
+// call calls m on v, taking the address of v or of a copy of it for pointer receivers
+func call(m reflect.Method, v reflect.Value) (_ reflect.Value, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = &methodError{method: m.Name, err: errors.New(fmt.Sprint(p))}
+		}
+	}()
+	if !v.CanAddr() {
+		c := reflect.New(v.Type())
+		c.Elem().Set(v)
+		v = c.Elem()
+	}
+	out := m.Func.Call([]reflect.Value{v.Addr()})
+	if len(out) == 2 && !out[1].IsNil() {
+		return reflect.Value{}, &methodError{method: m.Name, err: out[1].Interface().(error)}
+	}
+	return out[0], nil
+}
+
+// accessor is how a name resolves on a type: a chain of field indexes or a method, typ is what it yields
+type accessor struct {
+	ok     bool
+	index  []int
+	method *reflect.Method
+	typ    reflect.Type
+}
+
+type accessorKey struct {
+	t    reflect.Type
+	name string
+	r    resolver
+}
+
+// accessors caches accessor lookups, records of one type share them so only the first pays for the
+// reflection over fields and methods. Only names found on a type are kept so the cache is bounded by
+// the fields and methods of the types evaluated, names ignoring case are kept lowercased.
+var accessors sync.Map
+
+// accessor finds name on t through the accessors cache
+func (r resolver) accessor(t reflect.Type, name string) accessor {
+	r.strict = false
+	key := accessorKey{t: t, name: name, r: r}
+	if !r.caseSensitive {
+		key.name = strings.ToLower(name)
+	}
+	if a, ok := accessors.Load(key); ok {
+		return a.(accessor)
+	}
+	var a accessor
+	if t.Kind() == reflect.Struct {
+		if a.index, a.ok = r.field(t, name); a.ok {
+			a.typ = t.FieldByIndex(a.index).Type
+		}
+	}
+	if m, ok := r.method(t, name); ok && !a.ok {
+		a.ok, a.method, a.typ = true, &m, m.Type.Out(0)
+	}
+	if a.ok {
+		accessors.Store(key, a)
+	}
+	return a
+}
+
+// planStep is the accessor a name step takes on the type it meets there, on is nil for steps only
+// known while evaluating like those through interfaces and maps
+type planStep struct {
+	on reflect.Type
+	accessor
+}
+
+type planKey struct {
+	t reflect.Type
+	r resolver
+}
+
+// plan is the path compiled for records of type t, a chain of field indexes and methods holding one
+// entry per step of the path
+func (p *compiledPath) plan(r resolver, t reflect.Type) []planStep {
+	r.strict = false
+	key := planKey{t: t, r: r}
+	if pl, ok := p.plans.Load(key); ok {
+		return pl.([]planStep)
+	}
+	pl := r.compile(t, p.steps)
+	p.plans.Store(key, pl)
+	return pl
+}
+
+// compile follows path through t like resolveType, recording the accessor of every name step it meets
+func (r resolver) compile(t reflect.Type, path fieldPath) []planStep {
+	plan := make([]planStep, len(path))
+	for i := 0; t != nil && i < len(path); {
+		switch t.Kind() {
+		case reflect.Ptr:
+			t = t.Elem()
+			continue
+		case reflect.Interface, reflect.Map:
+			return plan
+		case reflect.Slice, reflect.Array:
+			if t == rawMessageType {
+				return plan
+			}
+			if path[i].kind != stepName {
+				i++
+			}
+			t = t.Elem()
+			continue
+		}
+		if path[i].kind != stepName {
+			return plan
+		}
+		a := r.accessor(t, path[i].name)
+		if !a.ok {
+			return plan
+		}
+		plan[i] = planStep{on: t, accessor: a}
+		t = a.typ
+		i++
+	}
+	return plan
+}
+
+// mapKey finds the entry of m called name, an exact match wins over one ignoring case
+func (r resolver) mapKey(m reflect.Value, name string) (reflect.Value, bool) {
+	if v := m.MapIndex(reflect.ValueOf(name).Convert(m.Type().Key())); v.IsValid() {
+		return v, true
+	}
+	if r.caseSensitive {
+		return reflect.Value{}, false
+	}
+	for _, k := range m.MapKeys() {
+		if strings.EqualFold(k.String(), name) {
+			return m.MapIndex(k), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// decodeJSON decodes raw keeping numbers as json.Number so integers stay exact
+func decodeJSON(raw []byte) (interface{}, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return nil, errFieldJSON
+	}
+	return v, nil
+}
+
+// isLeafList reports whether a value of type t at the end of a path is expanded into its elements,
+// slices are while arrays like uuid.UUID and []byte are kept whole
+func isLeafList(t reflect.Type) bool {
+	return t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8
+}
+
+// resolveType checks path exists on t, list reports whether it yields a list of values.
+// Interfaces can hold anything so paths through them are only checked when evaluating.
+func (r resolver) resolveType(t reflect.Type, path fieldPath) (ok bool, list bool) {
+	for t != nil {
+		switch t.Kind() {
+		case reflect.Ptr:
+			t = t.Elem()
+			continue
+		case reflect.Interface:
+			return true, list
+		case reflect.Map:
+			if len(path) == 0 {
+				return true, list
+			}
+			return t.Key().Kind() == reflect.String && (path[0].kind == stepName || path[0].kind == stepAll), list
+		case reflect.Slice, reflect.Array:
+			if t == rawMessageType {
+				return true, list
+			}
+			if len(path) == 0 {
+				return true, list || isLeafList(t)
+			}
+			switch path[0].kind {
+			case stepName:
+				list = true
+			case stepIndex:
+				path = path[1:]
+			default:
+				list, path = true, path[1:]
+			}
+			t = t.Elem()
+			continue
+		}
+		if len(path) == 0 {
+			return true, list
+		}
+		if path[0].kind != stepName {
+			return false, false
+		}
+		a := r.accessor(t, path[0].name)
+		if !a.ok {
+			return false, false
+		}
+		t, path = a.typ, path[1:]
+	}
+	return false, false
+}
+
+// blankFor is what a nil value of type t resolves to for the rest of path
+func (r resolver) blankFor(t reflect.Type, path fieldPath) ([]interface{}, error) {
+	ok, list := r.resolveType(t, path)
+	if !ok {
+		return nil, errFieldMissing
+	}
+	if r.strict {
+		return nil, errFieldBlank
+	}
+	if list {
+		return []interface{}{}, nil
+	}
+	return []interface{}{nil}, nil
+}
+
+// resolveValues resolves path from every value and lists the results
+func (r resolver) resolveValues(vs []reflect.Value, path fieldPath, plan []planStep) ([]interface{}, error) {
+	res := make([]interface{}, 0, len(vs))
+	for _, v := range vs {
+		vr, err := r.resolveValue(v, path, plan)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, vr...)
+	}
+	return res, nil
+}
+
+// elements lists the elements of the slice or array v from up to to
+func elements(v reflect.Value, from, to int) []reflect.Value {
+	vs := make([]reflect.Value, 0, to-from)
+	for i := from; i < to; i++ {
+		vs = append(vs, v.Index(i))
+	}
+	return vs
+}
+
+// resolveValue walks path from v, slices on the way are iterated so every element contributes its values
+// unless the path picks elements out of them. plan has an entry per step of path, names are only looked
+// up where v has another type than the one the plan was compiled for.
+func (r resolver) resolveValue(v reflect.Value, path fieldPath, plan []planStep) ([]interface{}, error) {
+	for {
+		switch v.Kind() {
+		case reflect.Invalid:
+			if r.strict {
+				return nil, errFieldBlank
+			}
+			return []interface{}{nil}, nil
+		case reflect.Ptr:
+			if v.IsNil() {
+				return r.blankFor(v.Type(), path)
+			}
+			if len(path) == 0 && v.Elem().Kind() == reflect.Struct {
+				// pointers to structs like *big.Rat are values of their own
+				return []interface{}{v.Interface()}, nil
+			}
+			v = v.Elem()
+			continue
+		case reflect.Interface:
+			if v.IsNil() {
+				return r.blankFor(v.Type(), path)
+			}
+			v = v.Elem()
+			continue
+		case reflect.Map:
+			if len(path) == 0 {
+				break
+			}
+			if v.Type().Key().Kind() != reflect.String {
+				return nil, errFieldMissing
+			}
+			if path[0].kind == stepAll {
+				keys := v.MapKeys()
+				sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+				vs := make([]reflect.Value, 0, len(keys))
+				for _, k := range keys {
+					vs = append(vs, v.MapIndex(k))
+				}
+				return r.resolveValues(vs, path[1:], plan[1:])
+			}
+			if path[0].kind != stepName {
+				return nil, errFieldMissing
+			}
+			e, ok := r.mapKey(v, path[0].name)
+			if !ok {
+				if r.strict {
+					return nil, errFieldMissing
+				}
+				return []interface{}{nil}, nil
+			}
+			v, path, plan = e, path[1:], plan[1:]
+			continue
+		case reflect.Slice, reflect.Array:
+			if v.Type() == rawMessageType {
+				if v.IsNil() {
+					return r.blankFor(v.Type(), path)
+				}
+				d, err := decodeJSON(v.Bytes())
+				if err != nil {
+					return nil, err
+				}
+				v = reflect.ValueOf(d)
+				continue
+			}
+			if len(path) == 0 && !isLeafList(v.Type()) {
+				break
+			}
+			if v.Kind() == reflect.Slice && v.IsNil() {
+				return r.blankFor(v.Type(), path)
+			}
+			if len(path) == 0 || path[0].kind == stepName {
+				return r.resolveValues(elements(v, 0, v.Len()), path, plan)
+			}
+			switch path[0].kind {
+			case stepIndex:
+				i, ok := path[0].element(v.Len())
+				if !ok {
+					return r.blankFor(v.Type().Elem(), path[1:])
+				}
+				v, path, plan = v.Index(i), path[1:], plan[1:]
+				continue
+			case stepSlice:
+				from, to := path[0].bounds(v.Len())
+				return r.resolveValues(elements(v, from, to), path[1:], plan[1:])
+			}
+			return r.resolveValues(elements(v, 0, v.Len()), path[1:], plan[1:])
+		}
+		if len(path) == 0 {
+			return []interface{}{v.Interface()}, nil
+		}
+		if path[0].kind != stepName {
+			return nil, errFieldMissing
+		}
+		a := plan[0].accessor
+		if plan[0].on != v.Type() {
+			a = r.accessor(v.Type(), path[0].name)
+		}
+		switch {
+		case !a.ok:
+			return nil, errFieldMissing
+		case a.method != nil:
+			res, err := call(*a.method, v)
+			if err != nil {
+				return nil, err
+			}
+			v = res
+		default:
+			f, ok := fieldByIndex(v, a.index)
+			if !ok {
+				return r.blankFor(a.typ, path[1:])
+			}
+			v = f
+		}
+		path, plan = path[1:], plan[1:]
+	}
+}
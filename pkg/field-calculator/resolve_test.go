@@ -0,0 +1,179 @@
+package fieldcalculator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type benchAudit struct {
+	CreatedBy, UpdatedBy string
+	Revision             int
+}
+
+type benchLine struct {
+	benchAudit
+	SKU, Name, Unit string
+	Qty             int
+	Price, Tax      float64
+	UnitPrice       float64 `calc:"unit_price"`
+}
+
+type benchReceipt struct {
+	ID    string
+	Lines []benchLine
+}
+
+func benchReceiptOf(n int) *benchReceipt {
+	lines := make([]benchLine, n)
+	for i := range lines {
+		lines[i] = benchLine{Qty: i % 7, Price: float64(i) / 100, UnitPrice: 1.25}
+	}
+	return &benchReceipt{ID: "r1", Lines: lines}
+}
+
+// BenchmarkFieldLookup compares finding a field by name with reflection against the accessors cache
+func BenchmarkFieldLookup(b *testing.B) {
+	r := resolver{}
+	t := reflect.TypeOf(benchLine{})
+	for _, name := range []string{"unit_price", "revision"} {
+		b.Run(name+"/uncached", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, ok := r.field(t, name); !ok {
+					b.FailNow()
+				}
+			}
+		})
+		b.Run(name+"/cached", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if a := r.accessor(t, name); !a.ok {
+					b.FailNow()
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRun(b *testing.B) {
+	rcpt := benchReceiptOf(10000)
+	ev := NewParser()
+	if err := ev.Parse("sum([lines.unit_price] * [lines.qty]) + [lines[-1].revision]"); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ev.Run(rcpt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkResolve compares resolving a path over many lines with its compiled plan against looking up
+// the names on every line
+func BenchmarkResolve(b *testing.B) {
+	rcpt := benchReceiptOf(10000)
+	r := resolver{}
+	path, err := parsePath("lines.revision", 0, len("lines.revision"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	cp := &compiledPath{steps: path}
+	v := reflect.ValueOf(rcpt)
+	b.Run("compiled", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := r.resolveValue(v, path, cp.plan(r, v.Type())); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("by name", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := r.resolveValue(v, path, make([]planStep, len(path))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestCompiledPath(t *testing.T) {
+	r := resolver{}
+	path, err := parsePath("lines[0].revision", 0, len("lines[0].revision"))
+	if err != nil {
+		t.Logf("err=%v", err)
+		t.FailNow()
+	}
+	cp := &compiledPath{steps: path}
+	plan := cp.plan(r, reflect.TypeOf(&benchReceipt{}))
+	if len(plan) != 3 || plan[0].on != reflect.TypeOf(benchReceipt{}) || plan[1].on != nil || plan[2].on != reflect.TypeOf(benchLine{}) {
+		t.Logf("every name step should be compiled against the type it meets, got=%+v", plan)
+		t.FailNow()
+	}
+	if len(plan[2].index) != 2 {
+		t.Logf("promoted fields should compile to an index chain, got=%+v", plan[2])
+		t.Fail()
+	}
+	if again := cp.plan(r, reflect.TypeOf(&benchReceipt{})); &again[0] != &plan[0] {
+		t.Logf("plans should be compiled once per type")
+		t.Fail()
+	}
+	if strict := (resolver{strict: true}); &cp.plan(strict, reflect.TypeOf(&benchReceipt{}))[0] != &plan[0] {
+		t.Logf("strict mode does not change the plan")
+		t.Fail()
+	}
+	if plan := cp.plan(r, reflect.TypeOf(map[string]interface{}{})); plan[0].on != nil {
+		t.Logf("paths through maps are only known while evaluating, got=%+v", plan)
+		t.Fail()
+	}
+	rcpt := benchReceiptOf(3)
+	rcpt.Lines[0].Revision = 4
+	vs, err := r.resolveValue(reflect.ValueOf(rcpt), path, plan)
+	if err != nil || len(vs) != 1 || vs[0] != 4 {
+		t.Logf("expected=[4],got=%v (%v)", vs, err)
+		t.Fail()
+	}
+}
+
+func TestAccessorsCache(t *testing.T) {
+	typ := reflect.TypeOf(benchLine{})
+	plain := resolver{}
+	tagged := resolver{tag: "json", caseSensitive: true}
+	if a := plain.accessor(typ, "unit_price"); !a.ok || a.typ.Kind() != reflect.Float64 {
+		t.Logf("unit_price should resolve through the calc tag, got=%+v", a)
+		t.Fail()
+	}
+	if a := tagged.accessor(typ, "unit_price"); a.ok {
+		t.Logf("accessors must not be shared between resolvers naming fields differently")
+		t.Fail()
+	}
+	if a := plain.accessor(typ, "revision"); !a.ok || len(a.index) != 2 {
+		t.Logf("promoted fields should resolve to an index chain, got=%+v", a)
+		t.Fail()
+	}
+	if a := plain.accessor(typ, "nope"); a.ok {
+		t.Logf("nope is not a field of benchLine")
+		t.Fail()
+	}
+	if _, ok := accessors.Load(accessorKey{t: typ, name: "nope", r: plain}); ok {
+		t.Logf("failed lookups must not be cached")
+		t.Fail()
+	}
+	plain.accessor(typ, "SKU")
+	plain.accessor(typ, "Sku")
+	n := 0
+	accessors.Range(func(k, _ interface{}) bool {
+		if key := k.(accessorKey); key.t == typ && key.r == plain && strings.EqualFold(key.name, "sku") {
+			n++
+		}
+		return true
+	})
+	if n != 1 {
+		t.Logf("spellings of a name ignoring case should share one entry, got %d", n)
+		t.Fail()
+	}
+	strict := plain
+	strict.strict = true
+	if a, b := plain.accessor(typ, "qty"), strict.accessor(typ, "qty"); !reflect.DeepEqual(a, b) {
+		t.Logf("strict mode does not change how fields are named")
+		t.Fail()
+	}
+}
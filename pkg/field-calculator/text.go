@@ -0,0 +1,258 @@
+package fieldcalculator
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Text functions count runes, not bytes, and positions are 1 based like in spreadsheets.
+
+// maxTextLength caps the strings REPT can build
+const maxTextLength = 32767
+
+// textOf is the text a value stands for in text functions, blanks are empty
+func textOf(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case bool:
+		if x {
+			return "TRUE"
+		}
+		return "FALSE"
+	}
+	return formatValue(v)
+}
+
+// countArg reads argument idx of fn as a count or position, fractions are truncated
+func countArg(fn string, idx int, v interface{}, min int) (int, error) {
+	f, ok := ToFloat64(v)
+	if !ok {
+		return 0, argError(idx, v, fmt.Sprintf("Field for %s is not a number", fn))
+	}
+	if f = math.Trunc(f); f < float64(min) {
+		return 0, argError(idx, v, fmt.Sprintf("%s argument %d must be at least %d", fn, idx+1, min))
+	} else if f > math.MaxInt32 {
+		return 0, argError(idx, v, fmt.Sprintf("%s argument %d must be at most %d", fn, idx+1, math.MaxInt32))
+	}
+	return int(f), nil
+}
+
+// textFunction builds an element-wise text function, optional trailing arguments are filled from defaults
+func textFunction(defaults []interface{}, f func([]interface{}) (interface{}, error)) func([]Token) (Token, error) {
+	return func(ts []Token) (Token, error) {
+		args := append(make([]Token, 0, len(ts)+len(defaults)), ts...)
+		for i := len(ts); i < len(defaults); i++ {
+			args = append(args, staticToken(defaults[i]))
+		}
+		return elementwiseN(args, f)
+	}
+}
+
+func fnConcat(ts []Token) (Token, error) {
+	var b strings.Builder
+	for _, t := range flattenTokens(ts) {
+		b.WriteString(textOf(t.Value))
+	}
+	return staticToken(b.String()), nil
+}
+
+// fnTextJoin is TEXTJOIN(delimiter, ignore_empty, values...)
+func fnTextJoin(ts []Token) (Token, error) {
+	if ts[0].Type == Scope || ts[1].Type == Scope {
+		return *(&Token{}), argError(0, ts[0].Value, "TEXTJOIN delimiter and ignore_empty must be single values")
+	}
+	ignore, err := truthyArg(1, ts[1].Value)
+	if err != nil {
+		return *(&Token{}), err
+	}
+	parts := make([]string, 0)
+	for _, t := range flattenTokens(ts[2:]) {
+		s := textOf(t.Value)
+		if ignore && s == "" {
+			continue
+		}
+		parts = append(parts, s)
+	}
+	return staticToken(strings.Join(parts, textOf(ts[0].Value))), nil
+}
+
+var fnLen = textFunction(nil, func(a []interface{}) (interface{}, error) {
+	return int64(utf8.RuneCountInString(textOf(a[0]))), nil
+})
+
+var fnLeft = textFunction([]interface{}{nil, int64(1)}, func(a []interface{}) (interface{}, error) {
+	n, err := countArg("LEFT", 1, a[1], 0)
+	if err != nil {
+		return nil, err
+	}
+	rs := []rune(textOf(a[0]))
+	if n > len(rs) {
+		n = len(rs)
+	}
+	return string(rs[:n]), nil
+})
+
+var fnRight = textFunction([]interface{}{nil, int64(1)}, func(a []interface{}) (interface{}, error) {
+	n, err := countArg("RIGHT", 1, a[1], 0)
+	if err != nil {
+		return nil, err
+	}
+	rs := []rune(textOf(a[0]))
+	if n > len(rs) {
+		n = len(rs)
+	}
+	return string(rs[len(rs)-n:]), nil
+})
+
+// runeSpan clamps the 1 based start and count to rs
+func runeSpan(rs []rune, start, n int) (int, int) {
+	from := start - 1
+	if from > len(rs) {
+		from = len(rs)
+	}
+	to := from + n
+	if to > len(rs) || to < from {
+		to = len(rs)
+	}
+	return from, to
+}
+
+var fnMid = textFunction(nil, func(a []interface{}) (interface{}, error) {
+	start, err := countArg("MID", 1, a[1], 1)
+	if err != nil {
+		return nil, err
+	}
+	n, err := countArg("MID", 2, a[2], 0)
+	if err != nil {
+		return nil, err
+	}
+	rs := []rune(textOf(a[0]))
+	from, to := runeSpan(rs, start, n)
+	return string(rs[from:to]), nil
+})
+
+var (
+	fnUpper = textFunction(nil, func(a []interface{}) (interface{}, error) {
+		return strings.ToUpper(textOf(a[0])), nil
+	})
+	fnLower = textFunction(nil, func(a []interface{}) (interface{}, error) {
+		return strings.ToLower(textOf(a[0])), nil
+	})
+	// fnProper capitalizes every letter following something that is not a letter
+	fnProper = textFunction(nil, func(a []interface{}) (interface{}, error) {
+		rs := []rune(strings.ToLower(textOf(a[0])))
+		for i, r := range rs {
+			if i == 0 || !unicode.IsLetter(rs[i-1]) {
+				rs[i] = unicode.ToTitle(r)
+			}
+		}
+		return string(rs), nil
+	})
+	// fnTrim strips spaces at both ends and collapses runs of spaces inside to one
+	fnTrim = textFunction(nil, func(a []interface{}) (interface{}, error) {
+		return strings.Join(strings.FieldsFunc(textOf(a[0]), func(r rune) bool { return r == ' ' }), " "), nil
+	})
+)
+
+// fnSubstitute is SUBSTITUTE(text, old, new[, instance]), without instance every occurrence is replaced
+var fnSubstitute = textFunction(nil, func(a []interface{}) (interface{}, error) {
+	s, old, repl := textOf(a[0]), textOf(a[1]), textOf(a[2])
+	instance := 0
+	if len(a) > 3 {
+		n, err := countArg("SUBSTITUTE", 3, a[3], 1)
+		if err != nil {
+			return nil, err
+		}
+		instance = n
+	}
+	if old == "" {
+		return s, nil
+	}
+	if instance == 0 {
+		return strings.ReplaceAll(s, old, repl), nil
+	}
+	idx := 0
+	for i := 1; ; i++ {
+		j := strings.Index(s[idx:], old)
+		if j < 0 {
+			return s, nil
+		}
+		if i == instance {
+			return s[:idx+j] + repl + s[idx+j+len(old):], nil
+		}
+		idx += j + len(old)
+	}
+})
+
+// fnReplace is REPLACE(text, start, count, new)
+var fnReplace = textFunction(nil, func(a []interface{}) (interface{}, error) {
+	start, err := countArg("REPLACE", 1, a[1], 1)
+	if err != nil {
+		return nil, err
+	}
+	n, err := countArg("REPLACE", 2, a[2], 0)
+	if err != nil {
+		return nil, err
+	}
+	rs := []rune(textOf(a[0]))
+	from, to := runeSpan(rs, start, n)
+	return string(rs[:from]) + textOf(a[3]) + string(rs[to:]), nil
+})
+
+// finder builds FIND and SEARCH, locate returns the byte offset of needle in haystack or -1
+func finder(fn string, locate func(needle, haystack string) int) func([]Token) (Token, error) {
+	return textFunction([]interface{}{nil, nil, int64(1)}, func(a []interface{}) (interface{}, error) {
+		start, err := countArg(fn, 2, a[2], 1)
+		if err != nil {
+			return nil, err
+		}
+		needle, rs := textOf(a[0]), []rune(textOf(a[1]))
+		if start > len(rs)+1 {
+			return nil, argError(2, a[2], fmt.Sprintf("%s start is past the end of the text", fn))
+		}
+		haystack := string(rs[start-1:])
+		i := locate(needle, haystack)
+		if i < 0 {
+			return nil, argError(0, a[0], fmt.Sprintf("%s did not find '%s'", fn, needle))
+		}
+		return int64(start + utf8.RuneCountInString(haystack[:i])), nil
+	})
+}
+
+var (
+	// fnFind is case sensitive
+	fnFind = finder("FIND", func(needle, haystack string) int {
+		return strings.Index(haystack, needle)
+	})
+	// fnSearch ignores case and takes * and ? wildcards
+	fnSearch = finder("SEARCH", func(needle, haystack string) int {
+		loc := regexp.MustCompile("(?is)" + wildcardExpr(needle)).FindStringIndex(haystack)
+		if loc == nil {
+			return -1
+		}
+		return loc[0]
+	})
+)
+
+var fnRept = textFunction(nil, func(a []interface{}) (interface{}, error) {
+	n, err := countArg("REPT", 1, a[1], 0)
+	if err != nil {
+		return nil, err
+	}
+	s := textOf(a[0])
+	if utf8.RuneCountInString(s)*n > maxTextLength {
+		return nil, argError(1, a[1], fmt.Sprintf("REPT result is longer than %d characters", maxTextLength))
+	}
+	return strings.Repeat(s, n), nil
+})
+
+var fnExact = textFunction(nil, func(a []interface{}) (interface{}, error) {
+	return textOf(a[0]) == textOf(a[1]), nil
+})